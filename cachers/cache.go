@@ -3,6 +3,7 @@ package cachers
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // Cache is the interface implemented by all caches.
@@ -26,3 +27,59 @@ type RemoteCache interface {
 	Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error)
 	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error)
 }
+
+// OutputGetter is implemented by local caches that can look up an output by
+// its OutputID alone. diskPath is empty if the output isn't cached.
+type OutputGetter interface {
+	GetOutput(ctx context.Context, outputID string) (diskPath string, err error)
+}
+
+// OutputLocator is implemented by remote caches that can remember which
+// action an output was stored for, so that it can be found by its OutputID
+// alone after a restart.
+type OutputLocator interface {
+	// RecordOutput remembers that outputID was stored for actionID.
+	RecordOutput(ctx context.Context, actionID, outputID string) error
+	// LocateOutput returns the action outputID was last recorded for, or
+	// an empty actionID if it wasn't.
+	LocateOutput(ctx context.Context, outputID string) (actionID string, err error)
+}
+
+// Entry describes a cached action.
+type Entry struct {
+	ActionID string    `json:"actionID"`
+	OutputID string    `json:"outputID"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`     // when it was stored
+	Accessed time.Time `json:"accessed"` // when it was last recorded as accessed, see AdminCache.Touch
+}
+
+// AdminCache is implemented by caches that can enumerate and remove their
+// entries.
+type AdminCache interface {
+	// List calls fn for the entries with action IDs greater than after,
+	// in action ID order, until fn returns false.
+	List(ctx context.Context, after string, fn func(Entry) bool) error
+	// Stat returns the entry of actionID, or ok false if it isn't cached.
+	Stat(ctx context.Context, actionID string) (e Entry, ok bool, err error)
+	// Delete removes actionID. Its output stays for other actions
+	// resolving to it; see DeleteOutput.
+	Delete(ctx context.Context, actionID string) (ok bool, err error)
+	// DeleteOutput removes the output with outputID, which the caller
+	// knows no action needs anymore. Actions still resolving to it miss
+	// from then on.
+	DeleteOutput(ctx context.Context, outputID string) (ok bool, err error)
+	// Purge removes all entries.
+	Purge(ctx context.Context) error
+	// Touch records that actionID was accessed at t.
+	Touch(ctx context.Context, actionID string, t time.Time) error
+}
+
+// WriterAtPutter is implemented by local caches that can store an output
+// written out of order, as ranged downloads do.
+type WriterAtPutter interface {
+	// PutWriterAt stores the size bytes of output outputID that fill writes
+	// to w, possibly from several goroutines at once. The entry is only
+	// stored if fill returns nil.
+	PutWriterAt(ctx context.Context, actionID, outputID string, size int64, fill func(w io.WriterAt) error) (diskPath string, err error)
+}
@@ -72,6 +72,10 @@ func (l *CombinedCache) Get(ctx context.Context, actionID string) (string, strin
 	}
 	diskPath, err = l.getsMetrics.DoWithMeasure(size, func() (string, error) {
 		defer output.Close() //nolint:errcheck
+		diskPath, err := l.putRanged(ctx, actionID, outputID, size, output)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return diskPath, err
+		}
 		return l.localCache.Put(ctx, actionID, outputID, size, output)
 	})
 	if err != nil {
@@ -80,6 +84,35 @@ func (l *CombinedCache) Get(ctx context.Context, actionID string) (string, strin
 	return outputID, diskPath, nil
 }
 
+// putRanged downloads a large output in parallel chunks straight into the
+// local cache. It returns errors.ErrUnsupported without reading output if
+// the output is too small or either cache can't do it.
+func (l *CombinedCache) putRanged(ctx context.Context, actionID, outputID string, size int64, output io.ReadCloser) (string, error) {
+	rg, ok := l.remoteCache.(RangeGetter)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	wp, ok := l.localCache.(WriterAtPutter)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	opts := rg.RangedDownloads()
+	if opts.Threshold <= 0 || size < opts.Threshold {
+		return "", errors.ErrUnsupported
+	}
+	return wp.PutWriterAt(ctx, actionID, outputID, size, func(w io.WriterAt) error {
+		return downloadRanges(ctx, rg, actionID, outputID, size, output, w, opts)
+	})
+}
+
+// GetOutput looks up outputID in the local cache only.
+func (l *CombinedCache) GetOutput(ctx context.Context, outputID string) (string, error) {
+	if og, ok := l.localCache.(OutputGetter); ok {
+		return og.GetOutput(ctx, outputID)
+	}
+	return "", nil
+}
+
 func (l *CombinedCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
 	pr, pw := io.Pipe()
 	wg, _ := errgroup.WithContext(ctx)
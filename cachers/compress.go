@@ -0,0 +1,86 @@
+package cachers
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Transfer compression between HTTPCache and go-cacher-server.
+//
+// The server lists the content codings it accepts for uploads in the
+// HeaderAcceptEncoding response header. Clients send "Accept-Encoding" as
+// usual for downloads and, once they saw the server accept a coding,
+// "Content-Encoding" with HeaderOutputSize holding the uncompressed size
+// for uploads. Sizes reported to callers are always uncompressed.
+const (
+	HeaderAcceptEncoding = "X-Cache-Accept-Encoding"
+
+	// MinCompressSize is the smallest output worth compressing.
+	MinCompressSize = 1 << 10
+)
+
+// Compression is a content coding for outputs.
+type Compression struct {
+	// Name is the HTTP content-coding token, like "gzip".
+	Name      string
+	NewWriter func(w io.Writer) io.WriteCloser
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	compressionsMu sync.RWMutex
+	compressions   = map[string]*Compression{
+		"gzip": {
+			Name:      "gzip",
+			NewWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		},
+	}
+)
+
+// RegisterCompression makes c available to HTTPCache and go-cacher-server
+// under c.Name, replacing any previous registration.
+func RegisterCompression(c *Compression) {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	compressions[c.Name] = c
+}
+
+// LookupCompression returns the compression registered under name, or nil.
+func LookupCompression(name string) *Compression {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	return compressions[name]
+}
+
+// AcceptsEncoding reports whether the comma separated list of content
+// codings in header, as in Accept-Encoding, includes name with a non-zero
+// quality.
+func AcceptsEncoding(header, name string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), name) {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// decompressingReader reads decompressed data and closes both the
+// decompressor and the underlying body.
+type decompressingReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (d *decompressingReader) Close() error {
+	err := d.ReadCloser.Close()
+	if err2 := d.body.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package cachers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -99,6 +100,14 @@ func (l *LocalCacheWithCounts) Get(ctx context.Context, actionID string) (output
 	return
 }
 
+// GetOutput delegates to the wrapped cache if it's an OutputGetter.
+func (l *LocalCacheWithCounts) GetOutput(ctx context.Context, outputID string) (string, error) {
+	if og, ok := l.cache.(OutputGetter); ok {
+		return og.GetOutput(ctx, outputID)
+	}
+	return "", nil
+}
+
 func (l *LocalCacheWithCounts) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
 	diskPath, err = l.cache.Put(ctx, actionID, outputID, size, body)
 	if err != nil {
@@ -109,6 +118,40 @@ func (l *LocalCacheWithCounts) Put(ctx context.Context, actionID, outputID strin
 	return
 }
 
+// PutWriterAt delegates to the wrapped cache if it's a WriterAtPutter and
+// returns errors.ErrUnsupported otherwise.
+func (l *LocalCacheWithCounts) PutWriterAt(ctx context.Context, actionID, outputID string, size int64, fill func(w io.WriterAt) error) (diskPath string, err error) {
+	wp, ok := l.cache.(WriterAtPutter)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	diskPath, err = wp.PutWriterAt(ctx, actionID, outputID, size, fill)
+	if err != nil {
+		l.putErrors.Add(1)
+		return
+	}
+	l.puts.Add(1)
+	return
+}
+
+// GetRange delegates to the wrapped cache if it's a RangeGetter.
+func (r *RemoteCacheWithCounts) GetRange(ctx context.Context, actionID, outputID string, off, length int64) (io.ReadCloser, error) {
+	rg, ok := r.cache.(RangeGetter)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return rg.GetRange(ctx, actionID, outputID, off, length)
+}
+
+// RangedDownloads returns the settings of the wrapped cache, or none if it
+// isn't a RangeGetter.
+func (r *RemoteCacheWithCounts) RangedDownloads() RangedDownloads {
+	if rg, ok := r.cache.(RangeGetter); ok {
+		return rg.RangedDownloads()
+	}
+	return RangedDownloads{}
+}
+
 func NewLocalCacheStates(cache LocalCache) *LocalCacheWithCounts {
 	return &LocalCacheWithCounts{
 		cache: cache,
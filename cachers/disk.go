@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -23,8 +24,15 @@ type indexEntry struct {
 
 // SimpleDiskCache is a LocalCache that stores data on disk.
 type SimpleDiskCache struct {
-	dir     string
-	verbose bool
+	dir            string
+	verbose        bool
+	staleTempAge   time.Duration
+	repairInterval time.Duration
+
+	stopRepair context.CancelFunc // or nil
+	repairing  sync.WaitGroup
+
+	listing listSnapshot // for List
 }
 
 func (dc *SimpleDiskCache) Kind() string {
@@ -40,11 +48,15 @@ func NewSimpleDiskCache(verbose bool, dir string) *SimpleDiskCache {
 
 var _ LocalCache = &SimpleDiskCache{}
 
-func (dc *SimpleDiskCache) Start(context.Context) error {
+func (dc *SimpleDiskCache) Start(ctx context.Context) error {
 	if dc.verbose {
 		log.Printf("[%s]\tlocal cache in  %s", dc.Kind(), dc.dir)
 	}
-	return os.MkdirAll(dc.dir, 0755)
+	if err := os.MkdirAll(dc.dir, 0755); err != nil {
+		return err
+	}
+	dc.startRepair(ctx)
+	return nil
 }
 
 func (dc *SimpleDiskCache) Get(_ context.Context, actionID string) (outputID, diskPath string, err error) {
@@ -68,6 +80,22 @@ func (dc *SimpleDiskCache) Get(_ context.Context, actionID string) (outputID, di
 	return ie.OutputID, filepath.Join(dc.dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
 }
 
+var _ OutputGetter = &SimpleDiskCache{}
+
+func (dc *SimpleDiskCache) GetOutput(_ context.Context, outputID string) (diskPath string, err error) {
+	if _, err := hex.DecodeString(outputID); err != nil || outputID == "" {
+		return "", nil
+	}
+	file := filepath.Join(dc.dir, fmt.Sprintf("o-%s", outputID))
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return "", err
+	}
+	return file, nil
+}
+
 func (dc *SimpleDiskCache) Put(_ context.Context, actionID, objectID string, size int64, body io.Reader) (diskPath string, _ error) {
 	file := filepath.Join(dc.dir, fmt.Sprintf("o-%s", objectID))
 
@@ -79,15 +107,64 @@ func (dc *SimpleDiskCache) Put(_ context.Context, actionID, objectID string, siz
 		}
 		_ = zf.Close()
 	} else {
-		wrote, err := writeAtomic(file, body)
+		// Check the size before the rename, so that an aborted upload
+		// leaves neither a truncated output nor its temp file behind.
+		tempFile, wrote, err := writeTempFile(file, body)
 		if err != nil {
 			return "", err
 		}
 		if wrote != size {
+			_ = os.Remove(tempFile)
 			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
 		}
+		if err := os.Rename(tempFile, file); err != nil {
+			_ = os.Remove(tempFile)
+			return "", err
+		}
 	}
 
+	if err := dc.writeIndex(actionID, objectID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+var _ WriterAtPutter = &SimpleDiskCache{}
+
+// PutWriterAt lets fill write the output into a temp file next to its final
+// place, which it is renamed to once fill succeeded.
+func (dc *SimpleDiskCache) PutWriterAt(_ context.Context, actionID, objectID string, size int64, fill func(w io.WriterAt) error) (diskPath string, err error) {
+	file := filepath.Join(dc.dir, fmt.Sprintf("o-%s", objectID))
+	tf, err := os.CreateTemp(dc.dir, filepath.Base(file)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tf.Close()
+		if err != nil {
+			_ = os.Remove(tf.Name())
+		}
+	}()
+	if err = tf.Truncate(size); err != nil {
+		return "", err
+	}
+	if err = fill(tf); err != nil {
+		return "", err
+	}
+	if err = tf.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tf.Name(), file); err != nil {
+		return "", err
+	}
+	if err = dc.writeIndex(actionID, objectID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// writeIndex records that actionID has output objectID of size bytes.
+func (dc *SimpleDiskCache) writeIndex(actionID, objectID string, size int64) error {
 	ij, err := json.Marshal(indexEntry{
 		Version:   1,
 		OutputID:  objectID,
@@ -95,16 +172,18 @@ func (dc *SimpleDiskCache) Put(_ context.Context, actionID, objectID string, siz
 		TimeNanos: time.Now().UnixNano(),
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
 	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
-	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
-		return "", err
-	}
-	return file, nil
+	_, err = writeAtomic(actionFile, bytes.NewReader(ij))
+	return err
 }
 
 func (dc *SimpleDiskCache) Close() error {
+	if dc.stopRepair != nil {
+		dc.stopRepair()
+	}
+	dc.repairing.Wait()
 	return nil
 }
 
@@ -0,0 +1,101 @@
+package cachers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimpleDiskCacheRepair(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dc := NewSimpleDiskCache(false, dir)
+	dc.SetStaleTempAge(-1)
+	require.NoError(t, dc.Start(ctx))
+	for _, id := range []string{"a001", "a002", "a003"} {
+		_, err := dc.Put(ctx, id, "b"+id[1:], 5, strings.NewReader("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, dc.Close())
+	// A killed process left temp files, and a deleted output left its
+	// action dangling.
+	old := time.Now().Add(-2 * DefaultStaleTempAge)
+	for _, name := range []string{"o-b001.123", "a-a001.456", "o-b002.789"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0644))
+	}
+	for _, name := range []string{"o-b001.123", "a-a001.456"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+	}
+	require.NoError(t, os.Remove(filepath.Join(dir, "o-b003")))
+
+	dc = NewSimpleDiskCache(false, dir)
+	require.NoError(t, dc.Start(ctx))
+	dc.repairing.Wait()
+	require.NoError(t, dc.Close())
+
+	for _, name := range []string{"o-b001.123", "a-a001.456", "a-a003"} {
+		assert.NoFileExists(t, filepath.Join(dir, name))
+	}
+	assert.FileExists(t, filepath.Join(dir, "o-b002.789"), "may still be being written")
+	for _, id := range []string{"a001", "a002"} {
+		outputID, _, err := dc.Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "b"+id[1:], outputID)
+	}
+
+	temps, dangling, err := dc.Repair(ctx, DefaultStaleTempAge, nil)
+	require.NoError(t, err)
+	assert.Zero(t, temps)
+	assert.Zero(t, dangling)
+
+	// Another Start within the repair interval leaves the next dangling
+	// entry for later.
+	require.NoError(t, os.Remove(filepath.Join(dir, "o-b002")))
+	dc = NewSimpleDiskCache(false, dir)
+	require.NoError(t, dc.Start(ctx))
+	require.NoError(t, dc.Close())
+	assert.FileExists(t, filepath.Join(dir, "a-a002"))
+
+	var removed []string
+	_, dangling, err = dc.Repair(ctx, DefaultStaleTempAge, func(actionID string) { removed = append(removed, actionID) })
+	require.NoError(t, err)
+	assert.Equal(t, 1, dangling)
+	assert.Equal(t, []string{"a002"}, removed)
+	assert.NoFileExists(t, filepath.Join(dir, "a-a002"))
+}
+
+func TestSimpleDiskCacheList(t *testing.T) {
+	ctx := context.Background()
+	dc := NewSimpleDiskCache(false, t.TempDir())
+	dc.SetStaleTempAge(-1)
+	require.NoError(t, dc.Start(ctx))
+	put := func(actionID string) {
+		_, err := dc.Put(ctx, actionID, "b"+actionID[1:], 5, strings.NewReader("hello"))
+		require.NoError(t, err)
+	}
+	list := func(after string, limit int) []string {
+		var ids []string
+		require.NoError(t, dc.List(ctx, after, func(e Entry) bool {
+			ids = append(ids, e.ActionID)
+			return len(ids) < limit
+		}))
+		return ids
+	}
+	for _, id := range []string{"a003", "a001", "a002", "a004"} {
+		put(id)
+	}
+	assert.Equal(t, []string{"a001", "a002"}, list("", 2))
+
+	// Pages after a cursor come from the first page's listing.
+	put("a005")
+	_, err := dc.Delete(ctx, "a003")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a004"}, list("a002", 10))
+	assert.Equal(t, []string{"a001", "a002", "a004", "a005"}, list("", 10))
+}
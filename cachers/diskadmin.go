@@ -0,0 +1,183 @@
+package cachers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ AdminCache = &SimpleDiskCache{}
+
+// readEntry reads the index file of actionID.
+// Its modification time is the entry's access time, see Touch.
+func (dc *SimpleDiskCache) readEntry(actionID string) (e Entry, ok bool, err error) {
+	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
+	fi, err := os.Stat(actionFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return e, false, err
+	}
+	ij, err := os.ReadFile(actionFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return e, false, err
+	}
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return e, false, nil
+	}
+	if _, err := hex.DecodeString(ie.OutputID); err != nil {
+		return e, false, nil
+	}
+	return Entry{
+		ActionID: actionID,
+		OutputID: ie.OutputID,
+		Size:     ie.Size,
+		Time:     time.Unix(0, ie.TimeNanos),
+		Accessed: fi.ModTime(),
+	}, true, nil
+}
+
+// listSnapshotAge is how long List continues after a cursor from the
+// action IDs it read for an earlier page, so that paging through a large
+// cache doesn't read the whole directory for every page.
+const listSnapshotAge = time.Minute
+
+// listSnapshot is the sorted action IDs of the last full listing.
+type listSnapshot struct {
+	mu        sync.Mutex
+	actionIDs []string
+	at        time.Time
+}
+
+// List lists from a fresh read of the directory when after is empty and
+// from the previous listing's snapshot for up to listSnapshotAge
+// otherwise. Entries added since may be missed by such continued
+// listings; removed entries are skipped.
+func (dc *SimpleDiskCache) List(ctx context.Context, after string, fn func(Entry) bool) error {
+	actionIDs, err := dc.listActionIDs(after == "")
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(actionIDs), func(i int) bool { return actionIDs[i] > after })
+	for _, actionID := range actionIDs[i:] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, ok, err := dc.readEntry(actionID)
+		if err != nil {
+			return err
+		}
+		if ok && !fn(e) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// listActionIDs returns the sorted IDs of the cached actions, reusing the
+// previous snapshot unless fresh is set or it is too old.
+func (dc *SimpleDiskCache) listActionIDs(fresh bool) ([]string, error) {
+	ls := &dc.listing
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !fresh && ls.actionIDs != nil && time.Since(ls.at) < listSnapshotAge {
+		return ls.actionIDs, nil
+	}
+	d, err := os.Open(dc.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close() //nolint:errcheck
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	actionIDs := make([]string, 0, len(names)/2)
+	for _, name := range names {
+		actionID, ok := strings.CutPrefix(name, "a-")
+		if ok && !strings.Contains(actionID, ".") {
+			// Temp files are "a-<id>.<random>".
+			actionIDs = append(actionIDs, actionID)
+		}
+	}
+	sort.Strings(actionIDs)
+	ls.actionIDs, ls.at = actionIDs, time.Now()
+	return actionIDs, nil
+}
+
+func (dc *SimpleDiskCache) Stat(_ context.Context, actionID string) (Entry, bool, error) {
+	if _, err := hex.DecodeString(actionID); err != nil || actionID == "" {
+		return Entry{}, false, nil
+	}
+	return dc.readEntry(actionID)
+}
+
+func (dc *SimpleDiskCache) Delete(_ context.Context, actionID string) (bool, error) {
+	if _, err := hex.DecodeString(actionID); err != nil || actionID == "" {
+		return false, nil
+	}
+	if _, ok, err := dc.readEntry(actionID); err != nil || !ok {
+		return false, err
+	}
+	if err := os.Remove(filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (dc *SimpleDiskCache) DeleteOutput(_ context.Context, outputID string) (bool, error) {
+	if _, err := hex.DecodeString(outputID); err != nil || outputID == "" {
+		return false, nil
+	}
+	if err := os.Remove(filepath.Join(dc.dir, fmt.Sprintf("o-%s", outputID))); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (dc *SimpleDiskCache) Purge(context.Context) error {
+	des, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasPrefix(name, "a-") || strings.HasPrefix(name, "o-") {
+			if err := os.Remove(filepath.Join(dc.dir, name)); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (dc *SimpleDiskCache) Touch(_ context.Context, actionID string, t time.Time) error {
+	if _, err := hex.DecodeString(actionID); err != nil || actionID == "" {
+		return nil
+	}
+	err := os.Chtimes(filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID)), t, t)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
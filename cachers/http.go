@@ -3,11 +3,20 @@ package cachers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ActionValue is the JSON value returned by the cacher server for an GET /action request.
@@ -16,6 +25,20 @@ type ActionValue struct {
 	Size     int64  `json:"size"`
 }
 
+// Single round-trip lookups: a GET /action request whose Accept header lists
+// ContentTypeOutput may be answered with the output bytes directly, described
+// by the HeaderOutputID and HeaderOutputSize response headers. Servers that
+// don't know the extension answer with an ActionValue as before, and the
+// client falls back to a GET /output request.
+const (
+	ContentTypeOutput = "application/octet-stream"
+	HeaderOutputID    = "X-Cache-Output-Id"
+	HeaderOutputSize  = "X-Cache-Output-Size"
+)
+
+// lookupAccept is sent with GET /action requests to ask for the output bytes.
+const lookupAccept = ContentTypeOutput + ", application/json;q=0.9"
+
 // HTTPCache is a RemoteCache that talks to a cacher server over HTTP.
 type HTTPCache struct {
 	// baseURL is the base URL of the cacher server, like "http://localhost:31364".
@@ -25,25 +48,159 @@ type HTTPCache struct {
 	// If nil, http.DefaultClient is used.
 	client *http.Client
 
+	// batcher optionally coalesces concurrent gets.
+	batcher *getBatcher
+
+	// maxRetries is the number of times a failed request is retried.
+	maxRetries int
+
+	// retries counts retried requests, retriesExhausted the requests that
+	// still failed after retrying.
+	retries          atomic.Int64
+	retriesExhausted atomic.Int64
+
+	// keyPrefix optionally namespaces action IDs, see actionKey.
+	keyPrefix string
+
+	// auth optionally adds credentials to every request.
+	auth HTTPAuth
+
+	// header optionally adds headers to every request.
+	header http.Header
+
+	// authErrOnce makes sure rejected credentials are reported once.
+	authErrOnce sync.Once
+
+	// compression optionally compresses outputs in transfer.
+	compression *Compression
+
+	// serverAcceptsCompression is set once the server said it accepts
+	// uploads compressed with compression.
+	serverAcceptsCompression atomic.Bool
+
+	// rangedDownloads configures downloading large outputs in chunks.
+	rangedDownloads RangedDownloads
+
 	// verbose optionally specifies whether to log verbose messages.
 	verbose bool
 }
 
-func NewHttpCache(baseURL string, verbose bool) *HTTPCache {
-	return &HTTPCache{
-		baseURL: baseURL,
-		verbose: verbose,
+// HTTPCacheOptions holds the optional settings of an HTTPCache.
+type HTTPCacheOptions struct {
+	// KeyPrefix optionally namespaces action IDs, see HTTPCache.actionKey.
+	KeyPrefix string
+
+	// Namespace optionally selects a go-cacher-server namespace, which
+	// the server keeps in separate storage with its own quota.
+	Namespace string
+
+	// Auth optionally adds credentials to every request.
+	Auth HTTPAuth
+
+	// Header optionally adds headers to every request.
+	Header http.Header
+
+	// TLSConfig optionally configures HTTPS, see NewClientTLSConfig.
+	TLSConfig *tls.Config
+
+	// RequestTimeout optionally bounds each request attempt, including
+	// reading the response body.
+	RequestTimeout time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for the server's response
+	// headers. Zero means DefaultHTTPResponseHeaderTimeout.
+	ResponseHeaderTimeout time.Duration
+
+	// MaxRetries is the number of retries of failed requests.
+	// Zero means DefaultHTTPMaxRetries, negative disables retries.
+	MaxRetries int
+
+	// MaxIdleConnsPerHost is the number of idle connections kept to the
+	// server. Zero means a default sized for cmd/go's parallelism.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost optionally limits the connections to the server.
+	MaxConnsPerHost int
+
+	// BatchWindow, if positive, enables coalescing of concurrent gets
+	// arriving within this window into one POST /batch/get request.
+	BatchWindow time.Duration
+
+	// MaxBatchSize is the most gets in one batch.
+	// Zero means DefaultHTTPMaxBatchSize.
+	MaxBatchSize int
+
+	// Compression optionally compresses outputs in both directions when the
+	// server supports it, see LookupCompression.
+	Compression *Compression
+
+	// RangedDownloads optionally enables downloading large outputs in
+	// parallel chunks that are resumed when interrupted, see RangeGetter.
+	RangedDownloads RangedDownloads
+}
+
+// unixBaseURL is the base URL of requests sent to a cacher server over its
+// Unix socket.
+const unixBaseURL = "http://unix"
+
+// UnixSocketPath returns the socket path of addr if it's the address of a
+// Unix socket, either "unix:/run/go-cacher.sock" or
+// "unix:///run/go-cacher.sock".
+func UnixSocketPath(addr string) (path string, ok bool) {
+	path, ok = strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(path, "//"), true
+}
+
+// NewHttpCache returns an HTTPCache talking to the cacher server at baseURL,
+// either an http(s):// URL or the unix: path of the server's socket, see
+// UnixSocketPath.
+func NewHttpCache(baseURL string, opts HTTPCacheOptions, verbose bool) *HTTPCache {
+	var socket string
+	if path, ok := UnixSocketPath(baseURL); ok {
+		socket, baseURL = path, unixBaseURL
+	}
+	if opts.Namespace != "" {
+		baseURL = strings.TrimSuffix(baseURL, "/") + "/ns/" + url.PathEscape(opts.Namespace)
 	}
+	c := &HTTPCache{
+		baseURL:         baseURL,
+		client:          newHTTPClient(opts, socket),
+		maxRetries:      opts.MaxRetries,
+		keyPrefix:       opts.KeyPrefix,
+		auth:            opts.Auth,
+		header:          opts.Header,
+		compression:     opts.Compression,
+		rangedDownloads: opts.RangedDownloads,
+		verbose:         verbose,
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultHTTPMaxRetries
+	}
+	c.maxRetries = max(c.maxRetries, 0)
+	if opts.BatchWindow > 0 {
+		c.batcher = newGetBatcher(c, opts.BatchWindow, opts.MaxBatchSize)
+	}
+	return c
 }
 
 func (c *HTTPCache) Start(context.Context) error {
 	if c.verbose {
-		log.Printf("[%s]\tconfigured to %s", c.Kind(), c.baseURL)
+		if c.keyPrefix != "" {
+			log.Printf("[%s]\tconfigured to %s (key prefix %s)", c.Kind(), c.baseURL, c.keyPrefix)
+		} else {
+			log.Printf("[%s]\tconfigured to %s", c.Kind(), c.baseURL)
+		}
 	}
 	return nil
 }
 
 func (c *HTTPCache) Close() error {
+	if c.verbose {
+		log.Printf("[%s]\t%d retries (%d requests failed after retrying)", c.Kind(), c.retries.Load(), c.retriesExhausted.Load())
+	}
 	return nil
 }
 
@@ -52,45 +209,164 @@ func (c *HTTPCache) Kind() string {
 }
 
 func (c *HTTPCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
-	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/action/"+actionID, nil)
-	res, err := c.httpClient().Do(req)
+	actionID = c.actionKey(actionID)
+	if c.batcher != nil {
+		if br, ok := c.batcher.get(ctx, actionID); ok {
+			switch {
+			case br.err != nil:
+				return "", 0, nil, br.err
+			case br.outputID == "":
+				return "", 0, nil, nil
+			case br.body != nil || br.size == 0:
+				return br.outputID, br.size, io.NopCloser(bytes.NewReader(br.body)), nil
+			default:
+				return c.getOutput(ctx, br.outputID, br.size)
+			}
+		}
+	}
+	hdr := c.acceptHeader()
+	hdr.Set("Accept", lookupAccept)
+	res, err := c.do(ctx, "GET", "/action/"+actionID, nil, 0, hdr)
 	if err != nil {
 		return "", 0, nil, err
 	}
+	if res.StatusCode == http.StatusOK && res.Header.Get(HeaderOutputID) != "" {
+		return c.lookupResult(res)
+	}
 	defer res.Body.Close() //nolint:errcheck
 	if res.StatusCode == http.StatusNotFound {
 		return "", 0, nil, nil
 	}
 	if res.StatusCode != http.StatusOK {
-		return "", 0, nil, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status)
+		return "", 0, nil, c.statusError(res, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status))
 	}
 	var av ActionValue
 	if err := json.NewDecoder(res.Body).Decode(&av); err != nil {
 		return "", 0, nil, err
 	}
-	outputID = av.OutputID
 	if av.Size == 0 {
-		return outputID, av.Size, io.NopCloser(bytes.NewReader(nil)), nil
+		return av.OutputID, av.Size, io.NopCloser(bytes.NewReader(nil)), nil
 	}
-	req, _ = http.NewRequestWithContext(ctx, "GET", c.baseURL+"/output/"+outputID, nil)
-	res, err = c.httpClient().Do(req)
+	return c.getOutput(ctx, av.OutputID, av.Size)
+}
+
+// getOutput fetches the bytes of outputID with GET /output.
+func (c *HTTPCache) getOutput(ctx context.Context, outputID string, size int64) (string, int64, io.ReadCloser, error) {
+	res, err := c.do(ctx, "GET", "/output/"+outputID, nil, 0, c.acceptHeader())
 	if err != nil {
 		return "", 0, nil, err
 	}
 	if res.StatusCode == http.StatusNotFound {
+		_ = res.Body.Close()
 		return "", 0, nil, nil
 	}
 	if res.StatusCode != http.StatusOK {
-		return "", 0, nil, fmt.Errorf("unexpected GET /output/%s status %v", outputID, res.Status)
+		_ = res.Body.Close()
+		return "", 0, nil, c.statusError(res, fmt.Errorf("unexpected GET /output/%s status %v", outputID, res.Status))
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		body, err := c.decodeBody(res)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return outputID, size, body, nil
 	}
 	if res.ContentLength == -1 {
+		_ = res.Body.Close()
 		return "", 0, nil, fmt.Errorf("no Content-Length from server")
 	}
-	return outputID, av.Size, res.Body, nil
+	return outputID, size, res.Body, nil
+}
+
+var _ RangeGetter = &HTTPCache{}
+
+// GetRange fetches part of outputID with a Range request on GET /output.
+// Outputs are content addressed, so no check for a changed output is needed.
+func (c *HTTPCache) GetRange(ctx context.Context, _, outputID string, off, length int64) (io.ReadCloser, error) {
+	hdr := http.Header{}
+	hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	res, err := c.do(ctx, "GET", "/output/"+outputID, nil, 0, hdr)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if res.ContentLength != length {
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("server sent %d bytes for range of %d of output %s", res.ContentLength, length, outputID)
+		}
+		return res.Body, nil
+	case http.StatusOK:
+		// The server ignored the range; skip to it.
+		if _, err := io.CopyN(io.Discard, res.Body, off); err != nil {
+			_ = res.Body.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(res.Body, length), res.Body}, nil
+	}
+	_ = res.Body.Close()
+	return nil, c.statusError(res, fmt.Errorf("unexpected ranged GET /output/%s status %v", outputID, res.Status))
+}
+
+func (c *HTTPCache) RangedDownloads() RangedDownloads {
+	return c.rangedDownloads
+}
+
+// lookupResult returns the output carried by a single round-trip lookup
+// response. See ContentTypeOutput.
+func (c *HTTPCache) lookupResult(res *http.Response) (outputID string, size int64, output io.ReadCloser, err error) {
+	outputID = res.Header.Get(HeaderOutputID)
+	size, err = strconv.ParseInt(res.Header.Get(HeaderOutputSize), 10, 64)
+	if err != nil || size < 0 {
+		_ = res.Body.Close()
+		return "", 0, nil, fmt.Errorf("bad %s header %q from server", HeaderOutputSize, res.Header.Get(HeaderOutputSize))
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		body, err := c.decodeBody(res)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return outputID, size, body, nil
+	}
+	if res.ContentLength != size {
+		_ = res.Body.Close()
+		return "", 0, nil, fmt.Errorf("server sent %d bytes for output %s of size %d", res.ContentLength, outputID, size)
+	}
+	return outputID, size, res.Body, nil
+}
 
+// acceptHeader returns the headers for requests that may return an output.
+func (c *HTTPCache) acceptHeader() http.Header {
+	hdr := http.Header{}
+	if c.compression != nil {
+		hdr.Set("Accept-Encoding", c.compression.Name)
+	}
+	return hdr
+}
+
+// decodeBody returns the decompressed body of res, closing it on error.
+func (c *HTTPCache) decodeBody(res *http.Response) (io.ReadCloser, error) {
+	enc := res.Header.Get("Content-Encoding")
+	if c.compression == nil || enc != c.compression.Name {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("unexpected Content-Encoding %q from server", enc)
+	}
+	zr, err := c.compression.NewReader(res.Body)
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("decoding %s output: %w", enc, err)
+	}
+	return &decompressingReader{ReadCloser: zr, body: res.Body}, nil
 }
 
 func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	actionID = c.actionKey(actionID)
+	if c.compression != nil && size >= MinCompressSize && c.serverAcceptsCompression.Load() {
+		return c.putCompressed(ctx, actionID, outputID, size, body)
+	}
 	var putBody io.Reader
 	if size == 0 {
 		// Special case the empty file so NewRequest sets "Content-Length: 0",
@@ -100,27 +376,118 @@ func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int
 	} else {
 		putBody = body
 	}
-	req, _ := http.NewRequestWithContext(ctx, "PUT", c.baseURL+"/"+actionID+"/"+outputID, putBody)
-	req.ContentLength = size
-	res, err := c.httpClient().Do(req)
+	res, err := c.do(ctx, "PUT", "/"+actionID+"/"+outputID, putBody, size, nil)
+	if err != nil {
+		log.Printf("error PUT /%s/%s: %v", actionID, outputID, err)
+		return err
+	}
+	return c.putResult(res, actionID, outputID)
+}
+
+// putCompressed streams body to the server compressed with c.compression.
+func (c *HTTPCache) putCompressed(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw := c.compression.NewWriter(pw)
+		_, err := io.Copy(zw, io.LimitReader(body, size))
+		if err == nil {
+			err = zw.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	hdr := http.Header{
+		"Content-Encoding": {c.compression.Name},
+		HeaderOutputSize:   {strconv.FormatInt(size, 10)},
+	}
+	res, err := c.do(ctx, "PUT", "/"+actionID+"/"+outputID, pr, -1, hdr)
+	// Stop the compressor if the request didn't drain it, and don't return
+	// while it may still read body.
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	<-done
 	if err != nil {
 		log.Printf("error PUT /%s/%s: %v", actionID, outputID, err)
 		return err
 	}
+	return c.putResult(res, actionID, outputID)
+}
+
+func (c *HTTPCache) putResult(res *http.Response, actionID, outputID string) error {
 	//nolint:errcheck
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusNoContent {
 		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
-		return fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all)
+		return c.statusError(res, fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all))
 	}
 	return nil
 }
 
 var _ RemoteCache = &HTTPCache{}
 
+// newRequest returns a request for path on the cacher server with
+// credentials attached.
+func (c *HTTPCache) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vv := range c.header {
+		req.Header[k] = vv
+	}
+	if c.auth != nil {
+		if err := c.auth.Authorize(req); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return req, nil
+}
+
+// statusError wraps err with ErrUnauthorized or ErrForbidden when the server
+// rejected our credentials. Those are logged once even when not verbose, as
+// CombinedCache tolerates failed puts silently.
+func (c *HTTPCache) statusError(res *http.Response, err error) error {
+	var authErr error
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		authErr = ErrUnauthorized
+	case http.StatusForbidden:
+		authErr = ErrForbidden
+	default:
+		return &statusError{code: res.StatusCode, err: err}
+	}
+	err = fmt.Errorf("%w: %w", authErr, err)
+	c.authErrOnce.Do(func() {
+		log.Printf("[%s]\t%v (further authentication errors are not logged)", c.Kind(), err)
+	})
+	return &statusError{code: res.StatusCode, err: err}
+}
+
+// statusError is an error caused by an unexpected response status.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
 func (c *HTTPCache) httpClient() *http.Client {
 	if c.client != nil {
 		return c.client
 	}
 	return http.DefaultClient
 }
+
+// actionKey returns the action ID to use on the wire.
+//
+// The cacher server protocol only accepts hex IDs, so rather than a path
+// prefix the key prefix is mixed into the action ID by hashing. Output IDs are
+// content addresses and are left alone.
+func (c *HTTPCache) actionKey(actionID string) string {
+	if c.keyPrefix == "" {
+		return actionID
+	}
+	sum := sha256.Sum256([]byte(c.keyPrefix + "/" + actionID))
+	return hex.EncodeToString(sum[:])
+}
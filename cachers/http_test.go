@@ -0,0 +1,258 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPCacheRetries(t *testing.T) {
+	var failures atomic.Int32
+	var putBodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case r.Method == "PUT":
+			b, _ := io.ReadAll(r.Body)
+			putBodies = append(putBodies, string(b))
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/action/"):
+			_, _ = io.WriteString(w, `{"outputID":"0123","size":2}`)
+		case strings.HasPrefix(r.URL.Path, "/output/"):
+			_, _ = io.WriteString(w, "hi")
+		}
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+
+	c := NewHttpCache(ts.URL, HTTPCacheOptions{}, false)
+	failures.Store(2)
+	outputID, size, rc, err := c.Get(ctx, "abcd")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(rc)
+	_ = rc.Close()
+	assert.Equal(t, "0123", outputID)
+	assert.Equal(t, int64(2), size)
+	assert.Equal(t, "hi", string(b))
+	assert.Equal(t, int64(2), c.retries.Load())
+
+	failures.Store(1)
+	require.NoError(t, c.Put(ctx, "abcd", "0123", 2, bytes.NewReader([]byte("hi"))))
+	assert.Equal(t, []string{"hi"}, putBodies)
+
+	// A consumed body that can't be rewound isn't sent again.
+	failures.Store(1)
+	err = c.Put(ctx, "abcd", "0123", 2, io.MultiReader(strings.NewReader("hi")))
+	assert.Error(t, err)
+	assert.Equal(t, int64(3), c.retries.Load())
+
+	c = NewHttpCache(ts.URL, HTTPCacheOptions{MaxRetries: -1}, false)
+	failures.Store(1)
+	_, _, _, err = c.Get(ctx, "abcd")
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), c.retries.Load())
+}
+
+func TestHTTPCacheRetryEarlyResponse(t *testing.T) {
+	var failures atomic.Int32
+	var mu sync.Mutex
+	var got []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			// Answer before reading the body, while the client still sends it.
+			w.Header().Set("Connection", "close")
+			http.Error(w, "slow down", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = b
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+	c := NewHttpCache(ts.URL, HTTPCacheOptions{}, false)
+	failures.Store(1)
+	require.NoError(t, c.Put(context.Background(), "abcd", "0123", int64(len(body)), bytes.NewReader(body)))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, len(body), len(got))
+	assert.True(t, bytes.Equal(body, got))
+}
+
+func TestHTTPCacheBatchFallback(t *testing.T) {
+	var posts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			// Like servers predating batches.
+			posts.Add(1)
+			http.Error(w, "bad method", http.StatusBadRequest)
+		case strings.HasPrefix(r.URL.Path, "/action/"):
+			_, _ = io.WriteString(w, `{"outputID":"0123","size":0}`)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewHttpCache(ts.URL, HTTPCacheOptions{BatchWindow: 20 * time.Millisecond}, false)
+	for range 2 {
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				outputID, _, _, err := c.Get(context.Background(), "abcd")
+				assert.NoError(t, err)
+				assert.Equal(t, "0123", outputID)
+			}()
+		}
+		wg.Wait()
+	}
+	assert.Equal(t, int32(1), posts.Load())
+}
+
+// cutWriter aborts the response after n body bytes, like a dropped
+// connection.
+type cutWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (cw *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > cw.n {
+		_, _ = cw.ResponseWriter.Write(p[:cw.n])
+		cw.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	cw.n -= len(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+func TestHTTPCacheRangedDownload(t *testing.T) {
+	const size = 1<<20 + 123
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var mu sync.Mutex
+	cut := map[string]bool{}
+	var ranged atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/action/"):
+			_, _ = io.WriteString(w, `{"outputID":"0123","size":1048699}`)
+		case r.URL.Path == "/output/0123":
+			if r.Header.Get("Range") != "" {
+				ranged.Add(1)
+			}
+			// Drop the first attempt of every request halfway.
+			mu.Lock()
+			first := !cut[r.Header.Get("Range")]
+			cut[r.Header.Get("Range")] = true
+			mu.Unlock()
+			if first {
+				w = &cutWriter{ResponseWriter: w, n: 50 << 10}
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	remote := NewHttpCache(ts.URL, HTTPCacheOptions{RangedDownloads: RangedDownloads{
+		Threshold:   512 << 10,
+		ChunkSize:   128 << 10,
+		Parallelism: 3,
+	}}, false)
+	local := NewSimpleDiskCache(false, t.TempDir())
+	for _, verbose := range []bool{false, true} {
+		c := NewCombinedCache(local, remote, verbose)
+		ctx := context.Background()
+		require.NoError(t, c.Start(ctx))
+		outputID, diskPath, err := c.Get(ctx, "ab"+strconv.FormatBool(verbose))
+		require.NoError(t, err)
+		assert.Equal(t, "0123", outputID)
+		got, err := os.ReadFile(diskPath)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "downloaded output differs")
+		require.NoError(t, c.Close())
+	}
+	// 8 chunks besides the first, each cut once and resumed.
+	assert.GreaterOrEqual(t, ranged.Load(), int32(2*8))
+}
+
+func TestHTTPCacheRangedDownloadOneConn(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/action/"):
+			fmt.Fprintf(w, `{"outputID":"0123","size":%d}`, len(data))
+		case r.URL.Path == "/output/0123":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	// The chunks after the first need the connection of the first one's
+	// body.
+	remote := NewHttpCache(ts.URL, HTTPCacheOptions{
+		MaxConnsPerHost: 1,
+		RangedDownloads: RangedDownloads{Threshold: 512 << 10, ChunkSize: 128 << 10, Parallelism: 3},
+	}, false)
+	c := NewCombinedCache(NewSimpleDiskCache(false, t.TempDir()), remote, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, c.Start(ctx))
+	defer c.Close() //nolint:errcheck
+	_, diskPath, err := c.Get(ctx, "ab")
+	require.NoError(t, err)
+	got, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "downloaded output differs")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		code   int
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{http.StatusTooManyRequests, "3", 3 * time.Second, true},
+		{http.StatusServiceUnavailable, now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second, true},
+		{http.StatusTooManyRequests, "3600", httpMaxRetryAfter, true},
+		{http.StatusTooManyRequests, "soon", 0, false},
+		{http.StatusTooManyRequests, "", 0, false},
+		{http.StatusInternalServerError, "3", 0, false},
+	} {
+		res := &http.Response{StatusCode: tt.code, Header: http.Header{}}
+		if tt.header != "" {
+			res.Header.Set("Retry-After", tt.header)
+		}
+		got, ok := retryAfter(res, now)
+		assert.Equal(t, tt.ok, ok, "%d %q", tt.code, tt.header)
+		assert.Equal(t, tt.want, got, "%d %q", tt.code, tt.header)
+	}
+}
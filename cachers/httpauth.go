@@ -0,0 +1,59 @@
+package cachers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned by HTTPCache when the server answered
+	// 401 Unauthorized, i.e. credentials are missing or unknown.
+	ErrUnauthorized = errors.New("cacher server rejected credentials")
+	// ErrForbidden is returned by HTTPCache when the server answered
+	// 403 Forbidden, i.e. the credentials lack the needed scope.
+	ErrForbidden = errors.New("cacher server denied access")
+)
+
+// HTTPAuth adds credentials to requests sent by HTTPCache.
+type HTTPAuth interface {
+	Authorize(req *http.Request) error
+}
+
+// BearerTokenAuth sends "Authorization: Bearer <Token>".
+type BearerTokenAuth struct {
+	Token string
+}
+
+func (a BearerTokenAuth) Authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+// BasicAuth sends HTTP basic auth credentials.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a BasicAuth) Authorize(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// ReadTokenFile returns the first line of the file at path with surrounding
+// whitespace removed. It's meant for secrets mounted into CI jobs.
+func ReadTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	token := strings.TrimSpace(line)
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
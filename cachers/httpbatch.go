@@ -0,0 +1,261 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Headers of the parts of a POST /batch/get response.
+const (
+	HeaderActionID      = "X-Cache-Action-Id"
+	HeaderOutputOmitted = "X-Cache-Output-Omitted"
+)
+
+const (
+	// DefaultHTTPMaxBatchSize is the most gets coalesced into one batch
+	// when HTTPCacheOptions.MaxBatchSize is zero.
+	DefaultHTTPMaxBatchSize = 100
+	// httpBatchMaxInline is the largest output fetched inline in a batch;
+	// larger ones are fetched with GET /output so batches stay small in memory.
+	httpBatchMaxInline = 1 << 20
+)
+
+// BatchRequest is the JSON body of POST /batch/exists and /batch/get.
+type BatchRequest struct {
+	ActionIDs []string `json:"actionIDs"`
+	// MaxInline is the largest output whose bytes /batch/get includes.
+	MaxInline int64 `json:"maxInline,omitempty"`
+}
+
+// BatchExistsResponse is the JSON response of POST /batch/exists.
+// Action IDs that aren't cached are absent from Entries.
+type BatchExistsResponse struct {
+	Entries map[string]ActionValue `json:"entries"`
+}
+
+// batchResult is the outcome of one get in a batch.
+type batchResult struct {
+	outputID string // or empty on miss
+	size     int64
+	body     []byte // nil if the output was omitted
+	err      error
+	// fallback tells the waiter to do a single lookup instead.
+	fallback bool
+}
+
+type batchWaiter struct {
+	actionID string
+	ch       chan batchResult
+}
+
+// getBatcher coalesces concurrent HTTPCache gets into POST /batch/get
+// requests. Gets arriving within window of the first pending one are sent
+// together.
+type getBatcher struct {
+	c       *HTTPCache
+	window  time.Duration
+	maxSize int
+
+	// unsupported is set once the server turned out not to know batches.
+	unsupported atomic.Bool
+
+	mu      sync.Mutex
+	pending []*batchWaiter
+	timer   *time.Timer
+}
+
+func newGetBatcher(c *HTTPCache, window time.Duration, maxSize int) *getBatcher {
+	if maxSize <= 0 {
+		maxSize = DefaultHTTPMaxBatchSize
+	}
+	return &getBatcher{c: c, window: window, maxSize: maxSize}
+}
+
+// get queues actionID into the next batch and waits for its result.
+// If ok is false the caller should do a single lookup instead.
+func (b *getBatcher) get(ctx context.Context, actionID string) (res batchResult, ok bool) {
+	if b.unsupported.Load() {
+		return res, false
+	}
+	w := &batchWaiter{actionID: actionID, ch: make(chan batchResult, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, w)
+	switch {
+	case len(b.pending) >= b.maxSize:
+		b.flushLocked()
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case res = <-w.ch:
+		return res, !res.fallback
+	case <-ctx.Done():
+		return batchResult{err: ctx.Err()}, true
+	}
+}
+
+func (b *getBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *getBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	switch len(batch) {
+	case 0:
+	case 1:
+		// Not worth a multipart response.
+		batch[0].ch <- batchResult{fallback: true}
+	default:
+		go b.fetch(batch)
+	}
+}
+
+// fetch sends batch to the server and hands the results to its waiters.
+func (b *getBatcher) fetch(batch []*batchWaiter) {
+	waiters := map[string][]*batchWaiter{}
+	br := BatchRequest{MaxInline: httpBatchMaxInline}
+	for _, w := range batch {
+		if _, dup := waiters[w.actionID]; !dup {
+			br.ActionIDs = append(br.ActionIDs, w.actionID)
+		}
+		waiters[w.actionID] = append(waiters[w.actionID], w)
+	}
+	finish := func(actionID string, res batchResult) {
+		for _, w := range waiters[actionID] {
+			w.ch <- res
+		}
+		delete(waiters, actionID)
+	}
+	// Not tied to any one waiter's context; each waiter stops waiting
+	// when its own context is done.
+	err := b.c.postBatch(context.Background(), br, finish)
+	if err == errBatchUnsupported {
+		if b.unsupported.CompareAndSwap(false, true) && b.c.verbose {
+			log.Printf("[%s]\tserver doesn't support batches; using single lookups", b.c.Kind())
+		}
+	}
+	// Whatever is left was a miss, unless the batch failed.
+	for actionID := range waiters {
+		res := batchResult{}
+		switch {
+		case err == errBatchUnsupported:
+			res.fallback = true
+		case err != nil:
+			res.err = err
+		}
+		finish(actionID, res)
+	}
+}
+
+// errBatchUnsupported is returned by postBatch for servers predating batches.
+var errBatchUnsupported = errors.New("batch requests not supported by server")
+
+// postBatch sends POST /batch/get and calls found for every part of the
+// response, in order.
+func (c *HTTPCache) postBatch(ctx context.Context, br BatchRequest, found func(actionID string, res batchResult)) error {
+	reqBody, err := json.Marshal(br)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{"Content-Type": {"application/json"}}
+	res, err := c.do(ctx, "POST", "/batch/get", bytes.NewReader(reqBody), int64(len(reqBody)), hdr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() //nolint:errcheck
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+		// Older servers reject POST outright.
+		return errBatchUnsupported
+	default:
+		return c.statusError(res, fmt.Errorf("unexpected POST /batch/get status %v", res.Status))
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		return errBatchUnsupported
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading batch response: %w", err)
+		}
+		actionID := part.Header.Get(HeaderActionID)
+		r := batchResult{outputID: part.Header.Get(HeaderOutputID)}
+		r.size, err = strconv.ParseInt(part.Header.Get(HeaderOutputSize), 10, 64)
+		if err != nil || r.size < 0 || r.outputID == "" {
+			return fmt.Errorf("bad batch response part for action %s", actionID)
+		}
+		if part.Header.Get(HeaderOutputOmitted) == "" {
+			r.body, err = io.ReadAll(io.LimitReader(part, r.size+1))
+			if err != nil {
+				return fmt.Errorf("reading batch response: %w", err)
+			}
+			if int64(len(r.body)) != r.size {
+				return fmt.Errorf("batch response has %d bytes for output %s of size %d", len(r.body), r.outputID, r.size)
+			}
+		}
+		found(actionID, r)
+	}
+}
+
+// Exists reports which of actionIDs the server has, using a single
+// POST /batch/exists request.
+func (c *HTTPCache) Exists(ctx context.Context, actionIDs []string) (map[string]ActionValue, error) {
+	br := BatchRequest{}
+	keys := map[string]string{} // wire action ID => caller's action ID
+	for _, id := range actionIDs {
+		key := c.actionKey(id)
+		keys[key] = id
+		br.ActionIDs = append(br.ActionIDs, key)
+	}
+	reqBody, err := json.Marshal(br)
+	if err != nil {
+		return nil, err
+	}
+	hdr := http.Header{"Content-Type": {"application/json"}}
+	res, err := c.do(ctx, "POST", "/batch/exists", bytes.NewReader(reqBody), int64(len(reqBody)), hdr)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() //nolint:errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, c.statusError(res, fmt.Errorf("unexpected POST /batch/exists status %v", res.Status))
+	}
+	var ber BatchExistsResponse
+	if err := json.NewDecoder(res.Body).Decode(&ber); err != nil {
+		return nil, err
+	}
+	found := map[string]ActionValue{}
+	for key, av := range ber.Entries {
+		if id, ok := keys[key]; ok {
+			found[id] = av
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,247 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHTTPMaxRetries is the number of retries of a failed request
+	// when HTTPCacheOptions.MaxRetries is zero.
+	DefaultHTTPMaxRetries = 2
+	// DefaultHTTPResponseHeaderTimeout bounds the wait for response headers
+	// when HTTPCacheOptions.ResponseHeaderTimeout is zero.
+	DefaultHTTPResponseHeaderTimeout = 30 * time.Second
+
+	httpRetryBaseDelay = 100 * time.Millisecond
+	httpRetryMaxDelay  = 5 * time.Second
+	// httpMaxRetryAfter caps the wait a server can ask for with Retry-After.
+	httpMaxRetryAfter = 30 * time.Second
+)
+
+// defaultHTTPMaxIdleConnsPerHost keeps enough idle connections around for
+// the bursts of parallel gets cmd/go issues, instead of net/http's default of 2.
+func defaultHTTPMaxIdleConnsPerHost() int {
+	return max(16, 4*runtime.GOMAXPROCS(0))
+}
+
+// newHTTPClient returns the http.Client for an HTTPCache configured by opts.
+// If socket is set, all connections go to that Unix socket.
+func newHTTPClient(opts HTTPCacheOptions, socket string) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = opts.TLSConfig
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	if socket != "" {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	t.MaxIdleConns = 0 // no global limit; MaxIdleConnsPerHost applies
+	t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = defaultHTTPMaxIdleConnsPerHost()
+	}
+	t.MaxConnsPerHost = opts.MaxConnsPerHost
+	// Compression is negotiated by HTTPCache itself, see Compression.
+	t.DisableCompression = true
+	t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	if t.ResponseHeaderTimeout == 0 {
+		t.ResponseHeaderTimeout = DefaultHTTPResponseHeaderTimeout
+	}
+	return &http.Client{
+		Transport: t,
+		Timeout:   opts.RequestTimeout,
+	}
+}
+
+// errBodyAbandoned is returned by reads of a request body after do gave up
+// on the request.
+var errBodyAbandoned = errors.New("request body abandoned")
+
+// countingReader counts the bytes read through it, so do knows whether a
+// failed request body was consumed. The transport may still be sending the
+// body when the response arrives, so do stops it before looking.
+type countingReader struct {
+	r io.Reader
+
+	mu      sync.Mutex
+	n       int64 // guarded by mu
+	stopped bool  // guarded by mu
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.stopped {
+		return 0, errBodyAbandoned
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// stop waits for a Read in progress, makes later ones fail, and returns
+// how many bytes were read.
+func (cr *countingReader) stop() int64 {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.stopped = true
+	return cr.n
+}
+
+// retryableStatus reports whether a response with the given status may be
+// retried.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the jittered exponential backoff before retry number
+// attempt (starting at 1).
+func retryDelay(attempt int) time.Duration {
+	d := httpRetryBaseDelay << (attempt - 1)
+	if d <= 0 || d > httpRetryMaxDelay {
+		d = httpRetryMaxDelay
+	}
+	// Full jitter, so parallel gets failing together don't retry together.
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// Do sends a request without body for path, such as "/admin/stats", to the
+// cacher server with the cache's credentials, headers and retries. It is
+// for endpoints the cache has no method for. The caller must close the
+// response body.
+func (c *HTTPCache) Do(ctx context.Context, method, path string) (*http.Response, error) {
+	return c.do(ctx, method, path, nil, 0, nil)
+}
+
+// do sends method path with body and the optional extra header to the cacher
+// server, retrying transport errors and transient statuses up to the
+// configured number of retries.
+//
+// GETs are always retried. Requests with a body are retried only if the body
+// is replayable: it implements io.Seeker, or no byte of it was consumed yet.
+// The caller must close the returned response body.
+func (c *HTTPCache) do(ctx context.Context, method, path string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	var (
+		seeker io.Seeker
+		start  int64
+	)
+	if s, ok := body.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			seeker, start = s, pos
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		var cr *countingReader
+		var reqBody io.Reader
+		switch {
+		case body != nil && size == 0:
+			// Make sure "Content-Length: 0" is sent rather than chunked
+			// encoding of an unknown length.
+			reqBody = http.NoBody
+		case body != nil:
+			cr = &countingReader{r: body}
+			reqBody = cr
+		}
+		req, err := c.newRequest(ctx, method, path, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.ContentLength = size
+		}
+		for k, vv := range header {
+			req.Header[k] = vv
+		}
+		res, err := c.httpClient().Do(req)
+		if err == nil && c.compression != nil && !c.serverAcceptsCompression.Load() &&
+			AcceptsEncoding(res.Header.Get(HeaderAcceptEncoding), c.compression.Name) {
+			c.serverAcceptsCompression.Store(true)
+		}
+		if err == nil && !retryableStatus(res.StatusCode) {
+			return res, nil
+		}
+		// A consumed body can only be sent again if we can rewind it.
+		var consumed int64
+		if cr != nil {
+			consumed = cr.stop()
+		}
+		replayable := consumed == 0 || seeker != nil
+		if attempt >= c.maxRetries || ctx.Err() != nil || !replayable {
+			if attempt > 0 {
+				c.retriesExhausted.Add(1)
+				if err != nil {
+					err = fmt.Errorf("%w (after %d retries)", err, attempt)
+				}
+			}
+			return res, err
+		}
+		cause := err
+		delay := retryDelay(attempt + 1)
+		if res != nil {
+			if d, ok := retryAfter(res, time.Now()); ok {
+				delay = d
+			}
+			cause = fmt.Errorf("status %v", res.Status)
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			_ = res.Body.Close()
+		}
+		if consumed > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, errors.Join(cause, err)
+			}
+		}
+		c.retries.Add(1)
+		if c.verbose {
+			log.Printf("[%s]\tretrying %s %s: %v", c.Kind(), method, path, cause)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryAfter returns the wait a 429 or 503 response asks for with its
+// Retry-After header, in seconds or as a date, capped at httpMaxRetryAfter.
+func retryAfter(res *http.Response, now time.Time) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(d, 0), httpMaxRetryAfter), true
+}
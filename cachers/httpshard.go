@@ -0,0 +1,336 @@
+package cachers
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardHealthInterval is how often servers marked down are probed.
+const shardHealthInterval = 5 * time.Second
+
+// maxReadRepairSize is the largest output Get keeps in memory to copy to
+// the replicas that missed it.
+const maxReadRepairSize = 32 << 20
+
+// ShardedHTTPCache is a RemoteCache that spreads actions over several cacher
+// servers by rendezvous hashing, so adding or removing a server only moves
+// the keys it gains or loses. Each action is stored on the first Replicas
+// servers of its ranking. Servers that fail are skipped, which moves their
+// keys to the next servers in the ranking, until a health probe finds them
+// up again.
+type ShardedHTTPCache struct {
+	nodes    []*shardNode
+	replicas int
+	ranged   RangedDownloads
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// verbose optionally specifies whether to log verbose messages.
+	verbose bool
+}
+
+// shardNode is one of the servers of a ShardedHTTPCache.
+type shardNode struct {
+	baseURL string
+	cache   *HTTPCache
+	down    atomic.Bool
+}
+
+var (
+	_ RemoteCache = &ShardedHTTPCache{}
+	_ RangeGetter = &ShardedHTTPCache{}
+)
+
+// NewShardedHttpCache returns a ShardedHTTPCache over the cacher servers at
+// baseURLs, each configured by opts. replicas is the number of servers an
+// action is stored on; zero means one.
+func NewShardedHttpCache(baseURLs []string, replicas int, opts HTTPCacheOptions, verbose bool) *ShardedHTTPCache {
+	c := &ShardedHTTPCache{
+		replicas: min(max(replicas, 1), len(baseURLs)),
+		ranged:   opts.RangedDownloads,
+		stop:     make(chan struct{}),
+		verbose:  verbose,
+	}
+	for _, u := range baseURLs {
+		c.nodes = append(c.nodes, &shardNode{
+			baseURL: u,
+			cache:   NewHttpCache(u, opts, verbose),
+		})
+	}
+	return c
+}
+
+func (c *ShardedHTTPCache) Kind() string {
+	return "http-sharded"
+}
+
+func (c *ShardedHTTPCache) Start(ctx context.Context) error {
+	for _, n := range c.nodes {
+		if err := n.cache.Start(ctx); err != nil {
+			return err
+		}
+	}
+	if c.verbose {
+		log.Printf("[%s]\t%d servers, %d replicas", c.Kind(), len(c.nodes), c.replicas)
+	}
+	c.wg.Add(1)
+	go c.healthLoop()
+	return nil
+}
+
+func (c *ShardedHTTPCache) Close() error {
+	close(c.stop)
+	c.wg.Wait()
+	var errAll error
+	for _, n := range c.nodes {
+		errAll = errors.Join(errAll, n.cache.Close())
+	}
+	return errAll
+}
+
+// Get asks the replicas of actionID in turn until one has it. The replicas
+// that missed it, like one that was down when it was stored, get a copy of
+// the output once it was read, see readRepair.
+func (c *ShardedHTTPCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	var missed []*shardNode
+	for _, n := range c.replicasOf(actionID) {
+		outputID, size, output, err = n.cache.Get(ctx, actionID)
+		if c.failed(ctx, n, err) {
+			continue
+		}
+		if err == nil && outputID == "" {
+			missed = append(missed, n)
+			continue
+		}
+		if err == nil && len(missed) > 0 {
+			output = c.readRepair(ctx, missed, actionID, outputID, size, output)
+		}
+		return outputID, size, output, err
+	}
+	if len(missed) > 0 {
+		return "", 0, nil, nil
+	}
+	return "", 0, nil, err
+}
+
+// readRepair returns output, keeping what's read from it for nodes. Once
+// output was read to the end, it's copied to them in the background, so
+// slow replicas don't hold up the reader. Outputs larger than
+// maxReadRepairSize aren't repaired.
+func (c *ShardedHTTPCache) readRepair(ctx context.Context, nodes []*shardNode, actionID, outputID string, size int64, output io.ReadCloser) io.ReadCloser {
+	if size > maxReadRepairSize {
+		return output
+	}
+	repair := func(b []byte) {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			err := c.putReplicas(context.WithoutCancel(ctx), nodes, actionID, outputID, size, bytes.NewReader(b))
+			if err != nil && c.verbose {
+				log.Printf("[%s]	repairing action %s: %v", c.Kind(), actionID, err)
+			}
+		}()
+	}
+	return &repairReader{ReadCloser: output, buf: make([]byte, 0, size), repair: repair}
+}
+
+// repairReader is an output being kept for the replicas that missed it.
+type repairReader struct {
+	io.ReadCloser
+	buf    []byte       // what was read; nil once more than its capacity arrived
+	repair func([]byte) // called on Close with the output if it was read to the end
+}
+
+func (r *repairReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.buf != nil {
+		if len(r.buf)+n > cap(r.buf) {
+			r.buf = nil
+		} else {
+			r.buf = append(r.buf, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+func (r *repairReader) Close() error {
+	if r.buf != nil && len(r.buf) == cap(r.buf) {
+		r.repair(r.buf)
+	}
+	r.buf = nil
+	return r.ReadCloser.Close()
+}
+
+// Put stores the output on all replicas of actionID at once. It succeeds if
+// any of them took it.
+func (c *ShardedHTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return c.putReplicas(ctx, c.replicasOf(actionID), actionID, outputID, size, body)
+}
+
+func (c *ShardedHTTPCache) putReplicas(ctx context.Context, nodes []*shardNode, actionID, outputID string, size int64, body io.Reader) error {
+	if len(nodes) == 1 {
+		err := nodes[0].cache.Put(ctx, actionID, outputID, size, body)
+		c.failed(ctx, nodes[0], err)
+		return err
+	}
+	errs := make([]error, len(nodes))
+	writers := make([]io.Writer, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		pr, pw := io.Pipe()
+		writers[i] = &replicaWriter{pw: pw}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = n.cache.Put(ctx, actionID, outputID, size, pr)
+			_ = pr.CloseWithError(io.ErrClosedPipe)
+			c.failed(ctx, n, errs[i])
+		}()
+	}
+	_, copyErr := io.Copy(io.MultiWriter(writers...), io.LimitReader(body, size))
+	for _, w := range writers {
+		_ = w.(*replicaWriter).pw.CloseWithError(copyErr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetRange fetches the range from the first replica of actionID that has it.
+func (c *ShardedHTTPCache) GetRange(ctx context.Context, actionID, outputID string, off, length int64) (rc io.ReadCloser, err error) {
+	for _, n := range c.replicasOf(actionID) {
+		rc, err = n.cache.GetRange(ctx, actionID, outputID, off, length)
+		if err == nil {
+			return rc, nil
+		}
+		c.failed(ctx, n, err)
+	}
+	return nil, err
+}
+
+func (c *ShardedHTTPCache) RangedDownloads() RangedDownloads {
+	return c.ranged
+}
+
+// replicaWriter writes to the pipe of one replica's put, dropping writes
+// once that put stopped reading so the other replicas carry on.
+type replicaWriter struct {
+	pw     *io.PipeWriter
+	failed bool
+}
+
+func (w *replicaWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		if _, err := w.pw.Write(p); err != nil {
+			w.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// replicasOf returns the servers to use for actionID: the first replicas
+// servers up in its ranking, or of all servers if none is up.
+func (c *ShardedHTTPCache) replicasOf(actionID string) []*shardNode {
+	ranked := c.rank(actionID)
+	up := slices.DeleteFunc(slices.Clone(ranked), func(n *shardNode) bool { return n.down.Load() })
+	if len(up) == 0 {
+		up = ranked
+	}
+	return up[:min(c.replicas, len(up))]
+}
+
+// rank returns the servers ordered by their rendezvous hash score for
+// actionID, highest first.
+func (c *ShardedHTTPCache) rank(actionID string) []*shardNode {
+	type scored struct {
+		n     *shardNode
+		score uint64
+	}
+	s := make([]scored, len(c.nodes))
+	for i, n := range c.nodes {
+		sum := sha256.Sum256([]byte(n.baseURL + "\x00" + actionID))
+		s[i] = scored{n, binary.BigEndian.Uint64(sum[:])}
+	}
+	slices.SortFunc(s, func(a, b scored) int { return cmp.Compare(b.score, a.score) })
+	ranked := make([]*shardNode, len(s))
+	for i, sc := range s {
+		ranked[i] = sc.n
+	}
+	return ranked
+}
+
+// failed reports whether err means that n is unavailable, and if so marks
+// it down. Responses other than 5xx and canceled requests don't count.
+func (c *ShardedHTTPCache) failed(ctx context.Context, n *shardNode, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) && se.code < 500 {
+		return false
+	}
+	if !n.down.Swap(true) {
+		log.Printf("[%s]\t%s is down: %v", c.Kind(), n.baseURL, err)
+	}
+	return true
+}
+
+// healthLoop probes the servers marked down until Close.
+func (c *ShardedHTTPCache) healthLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(shardHealthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		for _, n := range c.nodes {
+			if n.down.Load() && c.probe(n) == nil {
+				n.down.Store(false)
+				log.Printf("[%s]\t%s is up again", c.Kind(), n.baseURL)
+			}
+		}
+	}
+}
+
+// probe checks that n answers GET /, which needs no credentials.
+func (c *ShardedHTTPCache) probe(n *shardNode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shardHealthInterval)
+	defer cancel()
+	req, err := n.cache.newRequest(ctx, "GET", "/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := n.cache.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("status %v", res.Status)
+	}
+	return nil
+}
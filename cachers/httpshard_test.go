@@ -0,0 +1,204 @@
+package cachers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memServer is a minimal in-memory cacher server.
+type memServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	actions map[string]ActionValue
+	outputs map[string]string
+	putGate chan struct{} // if set, puts wait until it's closed
+}
+
+func newMemServer(t *testing.T) *memServer {
+	ms := &memServer{actions: map[string]ActionValue{}, outputs: map[string]string{}}
+	ms.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms.mu.Lock()
+		gate := ms.putGate
+		ms.mu.Unlock()
+		if r.Method == "PUT" && gate != nil {
+			<-gate
+		}
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		switch {
+		case r.Method == "PUT":
+			actionID, outputID, _ := strings.Cut(r.URL.Path[1:], "/")
+			b, _ := io.ReadAll(r.Body)
+			ms.actions[actionID] = ActionValue{OutputID: outputID, Size: int64(len(b))}
+			ms.outputs[outputID] = string(b)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasPrefix(r.URL.Path, "/action/"):
+			av, ok := ms.actions[strings.TrimPrefix(r.URL.Path, "/action/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"outputID":%q,"size":%d}`, av.OutputID, av.Size)
+		case strings.HasPrefix(r.URL.Path, "/output/"):
+			o, ok := ms.outputs[strings.TrimPrefix(r.URL.Path, "/output/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(o)))
+			_, _ = io.WriteString(w, o)
+		}
+	}))
+	t.Cleanup(ms.Close)
+	return ms
+}
+
+func (ms *memServer) len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.actions)
+}
+
+func TestShardedHTTPCache(t *testing.T) {
+	ctx := context.Background()
+	servers := []*memServer{newMemServer(t), newMemServer(t), newMemServer(t)}
+	var urls []string
+	for _, s := range servers {
+		urls = append(urls, s.URL)
+	}
+	c := NewShardedHttpCache(urls, 2, HTTPCacheOptions{MaxRetries: -1}, false)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close() //nolint:errcheck
+
+	const n = 60
+	for i := range n {
+		body := fmt.Sprintf("output %d", i)
+		require.NoError(t, c.Put(ctx, fmt.Sprintf("a%03d", i), fmt.Sprintf("o%03d", i), int64(len(body)), strings.NewReader(body)))
+	}
+	total := 0
+	for _, s := range servers {
+		assert.Greater(t, s.len(), n/3, "keys spread over all servers")
+		total += s.len()
+	}
+	assert.Equal(t, 2*n, total, "each key stored twice")
+
+	// Losing a server keeps all keys reachable through their other replica.
+	servers[0].CloseClientConnections()
+	servers[0].Close()
+	for i := range n {
+		outputID, size, body, err := c.Get(ctx, fmt.Sprintf("a%03d", i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("o%03d", i), outputID)
+		b, err := io.ReadAll(body)
+		require.NoError(t, err)
+		_ = body.Close()
+		assert.Equal(t, fmt.Sprintf("output %d", i), string(b))
+		assert.Equal(t, int64(len(b)), size)
+	}
+	assert.True(t, c.nodes[0].down.Load())
+}
+
+func TestShardedHTTPCacheReadRepair(t *testing.T) {
+	ctx := context.Background()
+	servers := map[string]*memServer{}
+	var urls []string
+	for range 3 {
+		s := newMemServer(t)
+		servers[s.URL] = s
+		urls = append(urls, s.URL)
+	}
+	c := NewShardedHttpCache(urls, 2, HTTPCacheOptions{MaxRetries: -1}, false)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close() //nolint:errcheck
+
+	// Only the second replica has it, as if the first was down for the put.
+	replicas := c.replicasOf("a001")
+	require.NoError(t, replicas[1].cache.Put(ctx, "a001", "o001", 5, strings.NewReader("hello")))
+	outputID, _, body, err := c.Get(ctx, "a001")
+	require.NoError(t, err)
+	assert.Equal(t, "o001", outputID)
+	b, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	assert.Equal(t, "hello", string(b))
+	assert.Eventually(t, func() bool { return servers[replicas[0].baseURL].len() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	outputID, _, _, err = c.Get(ctx, "a002")
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+}
+
+func TestShardedHTTPCacheReadRepairSlowReplica(t *testing.T) {
+	ctx := context.Background()
+	servers := map[string]*memServer{}
+	var urls []string
+	for range 2 {
+		s := newMemServer(t)
+		servers[s.URL] = s
+		urls = append(urls, s.URL)
+	}
+	c := NewShardedHttpCache(urls, 2, HTTPCacheOptions{MaxRetries: -1}, false)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close() //nolint:errcheck
+
+	// The replica missing the output doesn't take puts for now. Reading
+	// the output mustn't wait for it, even when it's too large to sit in
+	// the connection's buffers.
+	replicas := c.replicasOf("a001")
+	output := strings.Repeat("x", 16<<20)
+	require.NoError(t, replicas[1].cache.Put(ctx, "a001", "o001", int64(len(output)), strings.NewReader(output)))
+	slow := servers[replicas[0].baseURL]
+	gate := make(chan struct{})
+	slow.mu.Lock()
+	slow.putGate = gate
+	slow.mu.Unlock()
+
+	read := make(chan string, 1)
+	go func() {
+		outputID, _, body, err := c.Get(ctx, "a001")
+		if err != nil || outputID == "" {
+			read <- fmt.Sprint("get failed: ", err)
+			return
+		}
+		b, _ := io.ReadAll(body)
+		_ = body.Close()
+		read <- string(b)
+	}()
+	select {
+	case got := <-read:
+		assert.Equal(t, len(output), len(got))
+	case <-time.After(5 * time.Second):
+		t.Error("reading the output waited for the slow replica")
+	}
+	close(gate)
+	assert.Eventually(t, func() bool { return slow.len() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestShardedHTTPCacheReshuffle(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	owner := func(c *ShardedHTTPCache, key string) string {
+		return c.rank(key)[0].baseURL
+	}
+	c3 := NewShardedHttpCache(urls, 1, HTTPCacheOptions{}, false)
+	c4 := NewShardedHttpCache(append(urls, "http://d"), 1, HTTPCacheOptions{}, false)
+	moved := 0
+	for i := range 1000 {
+		key := fmt.Sprintf("%064x", i)
+		if before, after := owner(c3, key), owner(c4, key); before != after {
+			assert.Equal(t, "http://d", after, "keys only move to the new server")
+			moved++
+		}
+	}
+	assert.InDelta(t, 250, moved, 60)
+}
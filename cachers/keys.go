@@ -0,0 +1,154 @@
+package cachers
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// DefaultKeyTemplate is the layout of remote cache keys when no template is
+// configured. It matches the historical S3 layout.
+const DefaultKeyTemplate = "cache/{key}/{goarch}/{goos}"
+
+// ExpandKeyTemplate expands a remote key template into a key prefix.
+//
+// The template is a slash separated path that may reference the following
+// placeholders:
+//
+//	{key}       the user supplied cache key
+//	{goarch}    the target architecture ($GOARCH or runtime.GOARCH)
+//	{goos}      the target operating system ($GOOS or runtime.GOOS)
+//	{goversion} the version of the invoking Go toolchain, see GoVersion
+//
+// Environment variables are read with getenv, or os.Getenv if it's nil.
+// The Go version is only detected when the template references it.
+func ExpandKeyTemplate(tmpl, cacheKey string, getenv func(string) string) (string, error) {
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	var sb strings.Builder
+	rest := tmpl
+	for {
+		before, after, ok := strings.Cut(rest, "{")
+		sb.WriteString(before)
+		if !ok {
+			break
+		}
+		name, after, ok := strings.Cut(after, "}")
+		if !ok {
+			return "", fmt.Errorf("key template %q: unterminated placeholder", tmpl)
+		}
+		var value string
+		switch name {
+		case "key":
+			value = cacheKey
+		case "goarch":
+			value = cmp.Or(getenv("GOARCH"), runtime.GOARCH)
+		case "goos":
+			value = cmp.Or(getenv("GOOS"), runtime.GOOS)
+		case "goversion":
+			v, err := GoVersion(getenv)
+			if err != nil {
+				return "", fmt.Errorf("key template %q: %w", tmpl, err)
+			}
+			value = v
+		default:
+			return "", fmt.Errorf("key template %q: unknown placeholder {%s}", tmpl, name)
+		}
+		if value == "" || strings.Contains(value, "/") {
+			return "", fmt.Errorf("key template %q: invalid value %q for {%s}", tmpl, value, name)
+		}
+		sb.WriteString(value)
+		rest = after
+	}
+	prefix := strings.Trim(path.Clean("/"+sb.String()), "/")
+	if prefix == "" {
+		return "", fmt.Errorf("key template %q expands to an empty prefix", tmpl)
+	}
+	return prefix, nil
+}
+
+// GoVersion returns the version of the Go toolchain that invoked the cacher,
+// like "go1.25.1".
+//
+// It reads $GOROOT/VERSION when GOROOT is set and falls back to asking
+// "go env GOVERSION", preferring $GOROOT/bin/go over the go on $PATH.
+// GOROOT, and the variables in goToolchainEnv passed to the go command, are
+// read with getenv, or os.Getenv if it's nil.
+func GoVersion(getenv func(string) string) (string, error) {
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	goroot := getenv("GOROOT")
+	if goroot != "" {
+		if b, err := os.ReadFile(filepath.Join(goroot, "VERSION")); err == nil {
+			if v := sanitizeGoVersion(string(b)); strings.HasPrefix(v, "go") {
+				return v, nil
+			}
+		}
+	}
+	goBin := "go"
+	if goroot != "" {
+		goBin = filepath.Join(goroot, "bin", "go")
+	}
+	cmd := exec.Command(goBin, "env", "GOVERSION")
+	cmd.Env = goCommandEnv(getenv)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("detecting go version: %w", err)
+	}
+	v := sanitizeGoVersion(string(out))
+	if v == "" {
+		return "", fmt.Errorf("detecting go version: empty output from %s env GOVERSION", goBin)
+	}
+	return v, nil
+}
+
+// goToolchainEnv are the environment variables that decide which toolchain
+// "go env GOVERSION" runs and reports on.
+var goToolchainEnv = []string{
+	"GOROOT", "GOTOOLCHAIN", "GOENV", "GOPATH", "GOMODCACHE", "GOPROXY",
+	"GOFLAGS", "PATH", "HOME", "XDG_CONFIG_HOME",
+}
+
+// goCommandEnv returns the environment of the go command GoVersion runs:
+// the process's, with goToolchainEnv taken from getenv and GOCACHEPROG
+// cleared.
+func goCommandEnv(getenv func(string) string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if k != "GOCACHEPROG" && !slices.Contains(goToolchainEnv, k) {
+			env = append(env, kv)
+		}
+	}
+	for _, k := range goToolchainEnv {
+		if v := getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	// Never let the child go command start another cacher.
+	return append(env, "GOCACHEPROG=")
+}
+
+// sanitizeGoVersion turns the first line of a VERSION file or the output of
+// "go env GOVERSION" into a single path element.
+// "devel go1.26-abcdef Mon ..." becomes "devel-go1.26-abcdef".
+func sanitizeGoVersion(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return ""
+	case fields[0] == "devel" && len(fields) > 1:
+		return fields[0] + "-" + fields[1]
+	default:
+		return fields[0]
+	}
+}
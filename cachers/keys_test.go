@@ -0,0 +1,71 @@
+package cachers
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandKeyTemplate(t *testing.T) {
+	goroot := t.TempDir()
+	err := os.WriteFile(filepath.Join(goroot, "VERSION"), []byte("go1.25.1\ntime 2025-09-03T14:55:55Z\n"), 0644)
+	assert.NoError(t, err)
+	env := map[string]string{"GOROOT": goroot, "GOOS": "linux", "GOARCH": "arm64"}
+	getenv := func(key string) string { return env[key] }
+
+	tests := []struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{tmpl: DefaultKeyTemplate, want: "cache/v1/arm64/linux"},
+		{tmpl: "cache/{key}/{goarch}/{goos}/{goversion}", want: "cache/v1/arm64/linux/go1.25.1"},
+		{tmpl: "/{goversion}-{goos}/", want: "go1.25.1-linux"},
+		{tmpl: "cache/{nope}", wantErr: true},
+		{tmpl: "cache/{key", wantErr: true},
+		{tmpl: "/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			got, err := ExpandKeyTemplate(tt.tmpl, "v1", getenv)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSanitizeGoVersion(t *testing.T) {
+	assert.Equal(t, "go1.25.1", sanitizeGoVersion("go1.25.1\ntime 2025-09-03T14:55:55Z\n"))
+	assert.Equal(t, "go1.24.0", sanitizeGoVersion("go1.24.0 X:nocoverageredesign\n"))
+	assert.Equal(t, "devel-go1.26-abcdef", sanitizeGoVersion("devel go1.26-abcdef Mon Oct 6 10:00:00 2025 +0000\n"))
+	assert.Equal(t, "", sanitizeGoVersion("\n"))
+}
+
+func TestGoVersionEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as go command")
+	}
+	// No VERSION file, so the go command is asked; it must run with the
+	// injected environment rather than the process's.
+	goroot := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(goroot, "bin"), 0755))
+	script := "#!/bin/sh\n" +
+		"test \"$GOROOT\" = \"" + goroot + "\" -a -z \"$GOCACHEPROG\" || exit 1\n" +
+		"echo \"go1.99.0-$GOTOOLCHAIN\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(goroot, "bin", "go"), []byte(script), 0755))
+	t.Setenv("GOROOT", "/nonexistent")
+	t.Setenv("GOTOOLCHAIN", "process")
+	t.Setenv("GOCACHEPROG", "go-cacher")
+	env := map[string]string{"GOROOT": goroot, "GOTOOLCHAIN": "injected"}
+	v, err := GoVersion(func(key string) string { return env[key] })
+	require.NoError(t, err)
+	assert.Equal(t, "go1.99.0-injected", v)
+}
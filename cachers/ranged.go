@@ -0,0 +1,112 @@
+package cachers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// RangedDownloads configures the downloading of large outputs in parallel
+// chunks, see RangeGetter. The zero value disables it.
+type RangedDownloads struct {
+	// Threshold is the output size from which on outputs are downloaded
+	// in chunks. Zero disables ranged downloads.
+	Threshold int64
+
+	// ChunkSize is the size of each ranged request.
+	// Zero means DefaultRangedDownloads.ChunkSize.
+	ChunkSize int64
+
+	// Parallelism is the number of chunks downloaded at once.
+	// Zero means DefaultRangedDownloads.Parallelism.
+	Parallelism int
+}
+
+// DefaultRangedDownloads are the ranged download settings used by go-cacher.
+var DefaultRangedDownloads = RangedDownloads{
+	Threshold:   64 << 20,
+	ChunkSize:   8 << 20,
+	Parallelism: 4,
+}
+
+// maxChunkAttempts is the number of times a chunk is requested without
+// making progress before the download fails.
+const maxChunkAttempts = 4
+
+// RangeGetter is implemented by remote caches that can fetch part of an
+// output. CombinedCache uses it to download large outputs in parallel
+// chunks, resuming chunks whose connection broke instead of starting over.
+type RangeGetter interface {
+	// GetRange returns length bytes at offset off of output outputID,
+	// which Get returned for actionID.
+	GetRange(ctx context.Context, actionID, outputID string, off, length int64) (io.ReadCloser, error)
+	// RangedDownloads returns the settings for ranged downloads.
+	RangedDownloads() RangedDownloads
+}
+
+// downloadRanges writes the size bytes of output outputID to w in chunks
+// fetched in parallel with rg. The first chunk is read from first, the body
+// returned by Get, which saves a request. first is closed once the first
+// chunk is read, so that its connection is free for the other chunks.
+func downloadRanges(ctx context.Context, rg RangeGetter, actionID, outputID string, size int64, first io.ReadCloser, w io.WriterAt, opts RangedDownloads) error {
+	chunk := opts.ChunkSize
+	if chunk <= 0 {
+		chunk = DefaultRangedDownloads.ChunkSize
+	}
+	parallel := opts.Parallelism
+	if parallel <= 0 {
+		parallel = DefaultRangedDownloads.Parallelism
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallel)
+	for off := int64(0); off < size; off += chunk {
+		n := min(chunk, size-off)
+		var rc io.ReadCloser
+		if off == 0 {
+			rc = first
+		}
+		g.Go(func() error {
+			return downloadChunk(ctx, rg, actionID, outputID, off, n, rc, w)
+		})
+	}
+	return g.Wait()
+}
+
+// downloadChunk writes the n bytes at off of output outputID to w, reading
+// them from rc if not nil. rc is closed after reading. When a read fails,
+// the rest of the chunk is requested again.
+func downloadChunk(ctx context.Context, rg RangeGetter, actionID, outputID string, off, n int64, rc io.ReadCloser, w io.WriterAt) error {
+	for attempt := 1; ; attempt++ {
+		var err error
+		if rc == nil {
+			rc, err = rg.GetRange(ctx, actionID, outputID, off, n)
+		}
+		if err == nil {
+			var wrote int64
+			wrote, err = io.Copy(io.NewOffsetWriter(w, off), io.LimitReader(rc, n))
+			_ = rc.Close()
+			off, n = off+wrote, n-wrote
+			if err == nil && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				return nil
+			}
+			if wrote > 0 {
+				attempt = 1
+			}
+		}
+		if attempt >= maxChunkAttempts || ctx.Err() != nil {
+			return fmt.Errorf("downloading output %s at offset %d: %w", outputID, off, err)
+		}
+		rc = nil
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultStaleTempAge is how old a temp file left by an interrupted write
+// must be before SimpleDiskCache.Start removes it, see SetStaleTempAge.
+const DefaultStaleTempAge = time.Hour
+
+// DefaultRepairInterval is how long Start waits after a repair before
+// running another one, see SetRepairInterval.
+const DefaultRepairInterval = 24 * time.Hour
+
+// repairStamp is the file in the cache directory whose modification time
+// records when the last repair started.
+const repairStamp = "repair-stamp"
+
+// repairBatch is how many directory entries Repair reads at a time, so that
+// huge caches aren't listed into memory all at once.
+const repairBatch = 1024
+
+// SetStaleTempAge sets how old the temp files of interrupted writes must be
+// before the repair pass that Start runs in the background removes them. A
+// negative age disables that pass. It must be called before Start.
+func (dc *SimpleDiskCache) SetStaleTempAge(d time.Duration) {
+	dc.staleTempAge = d
+}
+
+// SetRepairInterval sets how long Start waits after a repair, by this or
+// any other process using the directory, before running another one.
+// Zero means DefaultRepairInterval and a negative interval repairs on every
+// Start. It must be called before Start.
+func (dc *SimpleDiskCache) SetRepairInterval(d time.Duration) {
+	dc.repairInterval = d
+}
+
+// startRepair runs Repair in the background until it's done or Close is
+// called, unless it's disabled or not due yet.
+func (dc *SimpleDiskCache) startRepair(ctx context.Context) {
+	age := dc.staleTempAge
+	if age < 0 || !dc.repairDue() {
+		return
+	}
+	if age == 0 {
+		age = DefaultStaleTempAge
+	}
+	ctx, dc.stopRepair = context.WithCancel(ctx)
+	dc.repairing.Add(1)
+	go func() {
+		defer dc.repairing.Done()
+		temps, dangling, err := dc.Repair(ctx, age, nil)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("[%s]\trepairing %s: %v", dc.Kind(), dc.dir, err)
+		case dc.verbose || temps > 0 || dangling > 0:
+			log.Printf("[%s]\trepaired %s: removed %d stale temp files and %d dangling index entries", dc.Kind(), dc.dir, temps, dangling)
+		}
+	}()
+}
+
+// repairDue reports whether the last repair of the directory started over
+// the repair interval ago, and if so records that one starts now, so that
+// concurrent processes don't all repair.
+func (dc *SimpleDiskCache) repairDue() bool {
+	interval := dc.repairInterval
+	if interval == 0 {
+		interval = DefaultRepairInterval
+	}
+	stamp := filepath.Join(dc.dir, repairStamp)
+	if fi, err := os.Stat(stamp); err == nil && interval > 0 && time.Since(fi.ModTime()) < interval {
+		return false
+	}
+	if err := os.WriteFile(stamp, nil, 0644); err != nil {
+		log.Printf("[%s]	recording repair of %s: %v", dc.Kind(), dc.dir, err)
+	}
+	return true
+}
+
+// Repairer is implemented by caches that can clean up after processes
+// killed mid-write.
+type Repairer interface {
+	// Repair removes the temp files of writes older than tempAge and the
+	// index entries whose outputs are missing, calling removed, if not nil,
+	// with the action ID of each of the latter.
+	Repair(ctx context.Context, tempAge time.Duration, removed func(actionID string)) (temps, dangling int, err error)
+}
+
+var _ Repairer = &SimpleDiskCache{}
+
+// Repair cleans up after processes killed mid-write: it removes the temp
+// files of writes older than tempAge and the index entries whose outputs
+// are missing, calling removed, if not nil, for each of the latter. The
+// cache stays usable while it runs.
+func (dc *SimpleDiskCache) Repair(ctx context.Context, tempAge time.Duration, removed func(actionID string)) (temps, dangling int, err error) {
+	d, err := os.Open(dc.dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer d.Close() //nolint:errcheck
+	for {
+		des, err := d.ReadDir(repairBatch)
+		for _, de := range des {
+			if err := ctx.Err(); err != nil {
+				return temps, dangling, err
+			}
+			name := de.Name()
+			if !strings.HasPrefix(name, "a-") && !strings.HasPrefix(name, "o-") {
+				continue
+			}
+			if strings.Contains(name, ".") {
+				// Temp files are "[ao]-<id>.<random>".
+				if dc.removeStaleTemp(de, tempAge) {
+					temps++
+				}
+				continue
+			}
+			if actionID, ok := strings.CutPrefix(name, "a-"); ok && dc.removeDangling(actionID) {
+				dangling++
+				if removed != nil {
+					removed(actionID)
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return temps, dangling, nil
+		}
+		if err != nil {
+			return temps, dangling, err
+		}
+	}
+}
+
+// removeStaleTemp removes the temp file de if it's older than age.
+func (dc *SimpleDiskCache) removeStaleTemp(de os.DirEntry, age time.Duration) bool {
+	fi, err := de.Info()
+	if err != nil || !fi.Mode().IsRegular() || time.Since(fi.ModTime()) < age {
+		return false
+	}
+	return os.Remove(filepath.Join(dc.dir, de.Name())) == nil
+}
+
+// removeDangling removes the index entry of actionID if its output is
+// missing. A Put may replace the entry meanwhile, so it's moved aside and
+// checked again first, and put back if it changed or its output appeared.
+func (dc *SimpleDiskCache) removeDangling(actionID string) bool {
+	actionFile := filepath.Join(dc.dir, "a-"+actionID)
+	ij, err := os.ReadFile(actionFile)
+	if err != nil || !dc.dangling(ij) {
+		return false
+	}
+	// The name looks like a temp file's, so a later repair removes it if
+	// this process dies before it's done.
+	aside := fmt.Sprintf("%s.repair%d", actionFile, os.Getpid())
+	if err := os.Rename(actionFile, aside); err != nil {
+		return false
+	}
+	defer os.Remove(aside) //nolint:errcheck
+	if got, err := os.ReadFile(aside); err == nil && bytes.Equal(got, ij) && dc.dangling(got) {
+		return true
+	}
+	// Link rather than rename so as not to clobber an even newer entry.
+	if err := os.Link(aside, actionFile); err != nil && !os.IsExist(err) {
+		log.Printf("[%s]	restoring index entry of %s: %v", dc.Kind(), actionID, err)
+	}
+	return false
+}
+
+// dangling reports whether the index entry ij names an output that's
+// missing.
+func (dc *SimpleDiskCache) dangling(ij []byte) bool {
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		// Not ours to judge; Get ignores it and Scrub removes it.
+		return false
+	}
+	if _, err := hex.DecodeString(ie.OutputID); err != nil || ie.OutputID == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dc.dir, "o-"+ie.OutputID))
+	return os.IsNotExist(err)
+}
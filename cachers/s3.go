@@ -7,9 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path"
-	"runtime"
 
 	"github.com/aws/smithy-go"
 
@@ -18,12 +15,14 @@ import (
 
 const (
 	outputIDMetadataKey = "outputid"
+	actionIDMetadataKey = "actionid"
 )
 
 // s3Client represents the functions we need from the S3 client
 type s3Client interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
 // S3Cache is a remote cache that is backed by S3 bucket
@@ -33,6 +32,8 @@ type S3Cache struct {
 	// verbose optionally specifies whether to log verbose messages.
 	verbose  bool
 	s3Client s3Client
+	// rangedDownloads configures downloading large outputs in chunks.
+	rangedDownloads RangedDownloads
 }
 
 var _ RemoteCache = &S3Cache{}
@@ -96,22 +97,114 @@ func (s *S3Cache) Put(ctx context.Context, actionID, outputID string, size int64
 	return
 }
 
-func (s *S3Cache) Close() error {
+// Stat returns the entry of actionID like AdminCache.Stat, without
+// downloading its output.
+func (s *S3Cache) Stat(ctx context.Context, actionID string) (Entry, bool, error) {
+	actionKey := s.actionKey(actionID)
+	res, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &actionKey,
+	})
+	if isNotFoundError(err) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("S3 head for %s: %w", actionKey, err)
+	}
+	e := Entry{ActionID: actionID, OutputID: res.Metadata[outputIDMetadataKey]}
+	if e.OutputID == "" {
+		return Entry{}, false, fmt.Errorf("outputId not found in metadata")
+	}
+	if res.ContentLength != nil {
+		e.Size = *res.ContentLength
+	}
+	if res.LastModified != nil {
+		e.Time = *res.LastModified
+	}
+	return e, true, nil
+}
+
+var _ OutputLocator = &S3Cache{}
+
+// RecordOutput stores an empty object under the output's key that names
+// actionID in its metadata.
+func (s *S3Cache) RecordOutput(ctx context.Context, actionID, outputID string) error {
+	outputKey := s.outputKey(outputID)
+	var size int64
+	_, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &s.bucket,
+		Key:           &outputKey,
+		Body:          bytes.NewReader(nil),
+		ContentLength: &size,
+		Metadata: map[string]string{
+			actionIDMetadataKey: actionID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("S3 put for %s: %w", outputKey, err)
+	}
 	return nil
 }
 
-func NewS3Cache(client s3Client, bucketName string, cacheKey string, verbose bool) *S3Cache {
-	// get target architecture
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		goarch = runtime.GOARCH
+// LocateOutput returns the action RecordOutput last stored for outputID.
+func (s *S3Cache) LocateOutput(ctx context.Context, outputID string) (string, error) {
+	outputKey := s.outputKey(outputID)
+	res, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &outputKey,
+	})
+	if isNotFoundError(err) {
+		return "", nil
 	}
-	// get target operating system
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		goos = runtime.GOOS
+	if err != nil {
+		return "", fmt.Errorf("S3 head for %s: %w", outputKey, err)
 	}
-	prefix := path.Join("cache", cacheKey, goarch, goos)
+	return res.Metadata[actionIDMetadataKey], nil
+}
+
+var _ RangeGetter = &S3Cache{}
+
+// GetRange fetches part of the output of actionID with a ranged GetObject.
+// It fails if the object was replaced by another output in the meantime.
+func (s *S3Cache) GetRange(ctx context.Context, actionID, outputID string, off, length int64) (io.ReadCloser, error) {
+	actionKey := s.actionKey(actionID)
+	rng := fmt.Sprintf("bytes=%d-%d", off, off+length-1)
+	res, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &actionKey,
+		Range:  &rng,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("S3 ranged get for %s: %w", actionKey, err)
+	}
+	if got := res.Metadata[outputIDMetadataKey]; got != outputID {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("S3 object %s changed from output %s to %s", actionKey, outputID, got)
+	}
+	if res.ContentLength != nil && *res.ContentLength != length {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("S3 sent %d bytes for range of %d of %s", *res.ContentLength, length, actionKey)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Cache) RangedDownloads() RangedDownloads {
+	return s.rangedDownloads
+}
+
+// SetRangedDownloads enables downloading large outputs in parallel chunks
+// that are resumed when interrupted, see RangeGetter.
+func (s *S3Cache) SetRangedDownloads(rd RangedDownloads) {
+	s.rangedDownloads = rd
+}
+
+func (s *S3Cache) Close() error {
+	return nil
+}
+
+// NewS3Cache returns an S3Cache that stores action entries in bucketName
+// under prefix, as produced by ExpandKeyTemplate.
+func NewS3Cache(client s3Client, bucketName string, prefix string, verbose bool) *S3Cache {
 	cache := &S3Cache{
 		s3Client: client,
 		bucket:   bucketName,
@@ -126,7 +219,8 @@ func isNotFoundError(err error) bool {
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
 			code := ae.ErrorCode()
-			return code == "AccessDenied" || code == "NoSuchKey"
+			// HEAD responses have no body to carry an error code.
+			return code == "AccessDenied" || code == "NoSuchKey" || code == "NotFound"
 		}
 	}
 	return false
@@ -135,3 +229,9 @@ func isNotFoundError(err error) bool {
 func (s *S3Cache) actionKey(actionID string) string {
 	return fmt.Sprintf("%s/%s", s.prefix, actionID)
 }
+
+// outputKey is where RecordOutput stores the action of outputID. Action
+// IDs are hex, so it can't collide with an action's key.
+func (s *S3Cache) outputKey(outputID string) string {
+	return fmt.Sprintf("%s/outputs/%s", s.prefix, outputID)
+}
@@ -0,0 +1,94 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory bucket.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bodies   map[string][]byte
+	metadata map[string]map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{bodies: map[string][]byte{}, metadata: map[string]map[string]string{}}
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bodies[*in.Key], f.metadata[*in.Key] = b, in.Metadata
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.bodies[*in.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	size := int64(len(b))
+	return &s3.HeadObjectOutput{ContentLength: &size, Metadata: f.metadata[*in.Key]}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.bodies[*in.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	if in.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		b = b[start:min(end+1, len(b))]
+	}
+	size := int64(len(b))
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b)), ContentLength: &size, Metadata: f.metadata[*in.Key]}, nil
+}
+
+func TestS3CacheGetRange(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	remote := NewS3Cache(newFakeS3(), "bucket", "prefix", false)
+	require.NoError(t, remote.Put(ctx, "ab", "0123", int64(len(data)), bytes.NewReader(data)))
+
+	rc, err := remote.GetRange(ctx, "ab", "0123", 10, 20)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, data[10:30], got)
+
+	_, err = remote.GetRange(ctx, "ab", "4567", 10, 20)
+	assert.ErrorContains(t, err, "changed")
+
+	remote.SetRangedDownloads(RangedDownloads{Threshold: 512 << 10, ChunkSize: 100 << 10, Parallelism: 3})
+	c := NewCombinedCache(NewSimpleDiskCache(false, t.TempDir()), remote, false)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close() //nolint:errcheck
+	outputID, diskPath, err := c.Get(ctx, "ab")
+	require.NoError(t, err)
+	assert.Equal(t, "0123", outputID)
+	got, err = os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "downloaded output differs")
+}
@@ -0,0 +1,244 @@
+package cachers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultOrphanAge is the default ScrubOptions.OrphanAge.
+const DefaultOrphanAge = time.Hour
+
+// ScrubOptions configures SimpleDiskCache.Scrub.
+type ScrubOptions struct {
+	// Rate is how many output bytes are hashed per second, so that
+	// scrubbing doesn't starve builds of disk bandwidth. Zero means as
+	// fast as possible.
+	Rate int64
+	// OrphanAge is how old an output nothing refers to must be before
+	// it's removed. Younger ones may be puts whose index entry isn't
+	// written yet. Zero means DefaultOrphanAge.
+	OrphanAge time.Duration
+	// DryRun reports problems without removing anything.
+	DryRun bool
+}
+
+// Kinds of ScrubProblem.
+const (
+	ScrubCorruptOutput  = "corrupt-output"  // the output doesn't hash to its output ID
+	ScrubBadIndex       = "bad-index"       // the index entry is unreadable or doesn't match its output
+	ScrubDanglingIndex  = "dangling-index"  // the index entry's output is missing or corrupt
+	ScrubOrphanedOutput = "orphaned-output" // no index entry refers to the output
+)
+
+// ScrubProblem is a problem Scrub found.
+type ScrubProblem struct {
+	Kind     string `json:"kind"`
+	ActionID string `json:"actionID,omitempty"` // of index entry problems
+	OutputID string `json:"outputID,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Removed  bool   `json:"removed"`
+}
+
+// ScrubReport is what Scrub checked and found.
+type ScrubReport struct {
+	Entries  int            `json:"entries"` // index entries checked
+	Outputs  int            `json:"outputs"` // outputs hashed
+	Bytes    int64          `json:"bytes"`   // output bytes hashed
+	Problems []ScrubProblem `json:"problems"`
+	Duration time.Duration  `json:"duration"`
+}
+
+// Scrubber is implemented by caches that can check their stored entries.
+type Scrubber interface {
+	Scrub(ctx context.Context, opts ScrubOptions) (*ScrubReport, error)
+}
+
+var _ Scrubber = &SimpleDiskCache{}
+
+// Scrub checks everything stored, at opts.Rate: that outputs hash to their
+// output IDs and that index entries parse and refer to an intact output of
+// their size. Unless opts.DryRun, it removes corrupt outputs, the index
+// entries that are unreadable or refer to missing or corrupt outputs, and
+// outputs nothing refers to. The cache stays usable while it runs.
+func (dc *SimpleDiskCache) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubReport, error) {
+	if opts.OrphanAge == 0 {
+		opts.OrphanAge = DefaultOrphanAge
+	}
+	start := time.Now()
+	rep := &ScrubReport{Problems: []ScrubProblem{}}
+	des, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return nil, err
+	}
+	var actionIDs []string
+	outputs := map[string]bool{} // outputID => intact
+	problem := func(p ScrubProblem, file string) {
+		if !opts.DryRun {
+			err := os.Remove(filepath.Join(dc.dir, file))
+			p.Removed = err == nil || os.IsNotExist(err)
+		}
+		if dc.verbose {
+			log.Printf("[%s]\tscrub: %s %s%s: %s", dc.Kind(), p.Kind, p.ActionID, p.OutputID, p.Detail)
+		}
+		rep.Problems = append(rep.Problems, p)
+	}
+
+	// Hash the outputs first, so that index entries referring to corrupt
+	// ones can go with them.
+	th := throttle{rate: opts.Rate, start: start}
+	for _, de := range des {
+		name := de.Name()
+		if strings.Contains(name, ".") {
+			// Temp files are "[ao]-<id>.<random>".
+			continue
+		}
+		if actionID, ok := strings.CutPrefix(name, "a-"); ok {
+			actionIDs = append(actionIDs, actionID)
+			continue
+		}
+		outputID, ok := strings.CutPrefix(name, "o-")
+		if !ok {
+			continue
+		}
+		n, err := hashMatches(filepath.Join(dc.dir, name), outputID)
+		if os.IsNotExist(err) {
+			continue
+		}
+		rep.Outputs++
+		rep.Bytes += n
+		outputs[outputID] = err == nil
+		if err != nil {
+			problem(ScrubProblem{Kind: ScrubCorruptOutput, OutputID: outputID, Detail: err.Error()}, name)
+		}
+		if err := th.wait(ctx, rep.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	referenced := map[string]bool{}
+	for _, actionID := range actionIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := "a-" + actionID
+		detail, outputID, err := dc.checkIndex(actionID, outputs)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		rep.Entries++
+		if outputID != "" {
+			referenced[outputID] = true
+		}
+		switch {
+		case detail == "":
+		case outputID == "" || outputs[outputID]:
+			problem(ScrubProblem{Kind: ScrubBadIndex, ActionID: actionID, OutputID: outputID, Detail: detail}, name)
+		default:
+			problem(ScrubProblem{Kind: ScrubDanglingIndex, ActionID: actionID, OutputID: outputID, Detail: detail}, name)
+		}
+	}
+
+	for outputID, intact := range outputs {
+		if !intact || referenced[outputID] {
+			continue
+		}
+		name := "o-" + outputID
+		fi, err := os.Stat(filepath.Join(dc.dir, name))
+		if err != nil || time.Since(fi.ModTime()) < opts.OrphanAge {
+			continue
+		}
+		problem(ScrubProblem{Kind: ScrubOrphanedOutput, OutputID: outputID, Detail: "no index entry refers to it"}, name)
+	}
+	rep.Duration = time.Since(start)
+	return rep, nil
+}
+
+// checkIndex checks the index entry of actionID against the outputs found
+// by Scrub. It returns what's wrong with it, or an empty detail if nothing
+// is. outputID is empty if the entry is unreadable.
+func (dc *SimpleDiskCache) checkIndex(actionID string, outputs map[string]bool) (detail, outputID string, err error) {
+	if _, err := hex.DecodeString(actionID); err != nil || actionID == "" {
+		return "bad action ID", "", nil
+	}
+	ij, err := os.ReadFile(filepath.Join(dc.dir, "a-"+actionID))
+	if err != nil {
+		return "", "", err
+	}
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return fmt.Sprintf("bad JSON: %v", err), "", nil
+	}
+	if _, err := hex.DecodeString(ie.OutputID); err != nil || ie.OutputID == "" {
+		return fmt.Sprintf("bad output ID %q", ie.OutputID), "", nil
+	}
+	intact, ok := outputs[ie.OutputID]
+	fi, err := os.Stat(filepath.Join(dc.dir, "o-"+ie.OutputID))
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return "", "", err
+	case err != nil:
+		return "output missing", ie.OutputID, nil
+	case ok && !intact:
+		return "output corrupt", ie.OutputID, nil
+	case ie.Size != fi.Size():
+		return fmt.Sprintf("size %d, but the output has %d bytes", ie.Size, fi.Size()), ie.OutputID, nil
+	}
+	return "", ie.OutputID, nil
+}
+
+// hashMatches checks that the file at path hashes to outputID, returning
+// how many bytes it read.
+func hashMatches(path, outputID string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close() //nolint:errcheck
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return n, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != outputID {
+		return n, fmt.Errorf("content hashes to %s", got)
+	}
+	return n, nil
+}
+
+// throttle paces work to rate bytes per second since start.
+type throttle struct {
+	rate  int64
+	start time.Time
+}
+
+// wait waits until done bytes are within the rate.
+func (th throttle) wait(ctx context.Context, done int64) error {
+	if th.rate <= 0 {
+		return ctx.Err()
+	}
+	due := th.start.Add(time.Duration(float64(done) / float64(th.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
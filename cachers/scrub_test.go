@@ -0,0 +1,102 @@
+package cachers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dc := NewSimpleDiskCache(false, dir)
+	dc.SetStaleTempAge(-1) // the dangling entries below are the scrub's to find
+	require.NoError(t, dc.Start(ctx))
+	put := func(actionID, body string) string {
+		sum := sha256.Sum256([]byte(body))
+		outputID := hex.EncodeToString(sum[:])
+		_, err := dc.Put(ctx, actionID, outputID, int64(len(body)), strings.NewReader(body))
+		require.NoError(t, err)
+		return outputID
+	}
+	put("a001", "good")
+	corrupt := put("a002", "rotten")
+	put("a003", "shared")
+	put("a004", "shared")
+	missing := put("a005", "gone")
+	orphan := put("a006", "orphan")
+	young := put("a007", "young")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "o-"+corrupt), []byte("rotted"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "o-"+missing)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a-a008"), []byte("{not json"), 0644))
+	for _, id := range []string{"a006", "a007"} {
+		require.NoError(t, os.Remove(filepath.Join(dir, "a-"+id)))
+	}
+	old := time.Now().Add(-2 * DefaultOrphanAge)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "o-"+orphan), old, old))
+
+	kinds := func(rep *ScrubReport) map[string][]string {
+		m := map[string][]string{}
+		for _, p := range rep.Problems {
+			m[p.Kind] = append(m[p.Kind], p.ActionID+p.OutputID)
+		}
+		return m
+	}
+	want := map[string][]string{
+		ScrubCorruptOutput:  {corrupt},
+		ScrubDanglingIndex:  {"a002" + corrupt, "a005" + missing},
+		ScrubBadIndex:       {"a008"},
+		ScrubOrphanedOutput: {orphan},
+	}
+
+	rep, err := dc.Scrub(ctx, ScrubOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, want, kinds(rep))
+	assert.Equal(t, 6, rep.Entries)
+	assert.Equal(t, 5, rep.Outputs)
+	assert.FileExists(t, filepath.Join(dir, "a-a008"))
+
+	rep, err = dc.Scrub(ctx, ScrubOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, want, kinds(rep))
+	for _, p := range rep.Problems {
+		assert.True(t, p.Removed, p.Kind)
+	}
+	for _, name := range []string{"o-" + corrupt, "a-a002", "a-a005", "a-a008", "o-" + orphan} {
+		assert.NoFileExists(t, filepath.Join(dir, name))
+	}
+	assert.FileExists(t, filepath.Join(dir, "o-"+young), "too young to be an orphan")
+	for _, id := range []string{"a001", "a003", "a004"} {
+		outputID, _, err := dc.Get(ctx, id)
+		require.NoError(t, err)
+		assert.NotEmpty(t, outputID)
+	}
+
+	rep, err = dc.Scrub(ctx, ScrubOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, rep.Problems)
+}
+
+func TestScrubRate(t *testing.T) {
+	ctx := context.Background()
+	dc := NewSimpleDiskCache(false, t.TempDir())
+	dc.SetStaleTempAge(-1)
+	require.NoError(t, dc.Start(ctx))
+	body := strings.Repeat("x", 1000)
+	sum := sha256.Sum256([]byte(body))
+	_, err := dc.Put(ctx, "a001", hex.EncodeToString(sum[:]), int64(len(body)), strings.NewReader(body))
+	require.NoError(t, err)
+	start := time.Now()
+	rep, err := dc.Scrub(ctx, ScrubOptions{Rate: 5000})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), rep.Bytes)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`              // token name or IP address
+	Namespace  string    `json:"namespace,omitempty"` // empty for the default namespace
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Endpoint   string    `json:"endpoint"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	DurationMS float64   `json:"durationMs"`
+	Hits       int64     `json:"hits,omitempty"`   // actions found
+	Misses     int64     `json:"misses,omitempty"` // actions not found
+	Replica    bool      `json:"replica,omitempty"`
+}
+
+// accessLog writes one JSON line per request. It's shared by all
+// namespaces. Its methods are no-ops on a nil *accessLog.
+type accessLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder // guarded by mu
+	c   io.Closer     // or nil
+}
+
+// openAccessLog opens the access log at path, appending to it, or writes
+// it to stdout if path is "-".
+func openAccessLog(path string) (*accessLog, error) {
+	if path == "-" {
+		return newAccessLog(os.Stdout, nil), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return newAccessLog(f, f), nil
+}
+
+func newAccessLog(w io.Writer, c io.Closer) *accessLog {
+	return &accessLog{enc: json.NewEncoder(w), c: c}
+}
+
+func (al *accessLog) log(e *accessEntry) {
+	if al == nil {
+		return
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	// A full disk shouldn't take the cache down with it.
+	_ = al.enc.Encode(e)
+}
+
+func (al *accessLog) close() error {
+	if al == nil || al.c == nil {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.c.Close()
+}
+
+// lookupCounts counts the cache hits and misses of one request, for its
+// access log entry.
+type lookupCounts struct {
+	hits, misses atomic.Int64
+}
+
+type lookupCountsKey struct{}
+
+// lookup records a cache hit or miss of r.
+func (s *server) lookup(r *http.Request, hit bool) {
+	s.metrics.lookup(hit)
+	lc, _ := r.Context().Value(lookupCountsKey{}).(*lookupCounts)
+	switch {
+	case lc == nil:
+	case hit:
+		lc.hits.Add(1)
+	default:
+		lc.misses.Add(1)
+	}
+}
+
+// withLookupCounts returns r with a lookupCounts for s.lookup to fill in,
+// if s has an access log.
+func (s *server) withLookupCounts(r *http.Request) (*http.Request, *lookupCounts) {
+	if s.access == nil {
+		return r, nil
+	}
+	lc := new(lookupCounts)
+	return r.WithContext(context.WithValue(r.Context(), lookupCountsKey{}, lc)), lc
+}
+
+// usage sums up the access log entries of a client or namespace.
+type usage struct {
+	key               string
+	requests          int64
+	hits, misses      int64
+	puts              int64
+	bytesIn, bytesOut int64
+	duration          time.Duration
+}
+
+// summarize reads the access log lines from r and sums them up by client,
+// namespace, or both, as chosen by by. Lines from since on are counted.
+func summarize(r io.Reader, by string, since time.Time, into map[string]*usage) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var e accessEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if e.Time.Before(since) {
+			continue
+		}
+		var key string
+		switch by {
+		case "client":
+			key = e.Client
+		case "namespace":
+			key = cmp.Or(e.Namespace, "(default)")
+		case "client,namespace":
+			key = e.Client + " " + cmp.Or(e.Namespace, "(default)")
+		default:
+			return fmt.Errorf("unknown grouping %q", by)
+		}
+		u := into[key]
+		if u == nil {
+			u = &usage{key: key}
+			into[key] = u
+		}
+		u.requests++
+		u.hits += e.Hits
+		u.misses += e.Misses
+		if e.Endpoint == "put" && e.Status < 300 {
+			u.puts++
+		}
+		u.bytesIn += e.BytesIn
+		u.bytesOut += e.BytesOut
+		u.duration += time.Duration(e.DurationMS * float64(time.Millisecond))
+	}
+	return sc.Err()
+}
+
+// writeReport writes usages as a table, the heaviest users first.
+func writeReport(w io.Writer, by string, usages map[string]*usage) error {
+	sorted := make([]*usage, 0, len(usages))
+	for _, u := range usages {
+		sorted = append(sorted, u)
+	}
+	slices.SortFunc(sorted, func(a, b *usage) int {
+		return cmp.Or(
+			cmp.Compare(b.bytesIn+b.bytesOut, a.bytesIn+a.bytesOut),
+			cmp.Compare(b.requests, a.requests),
+			strings.Compare(a.key, b.key))
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\trequests\thits\tmisses\thit rate\tputs\tbytes in\tbytes out\ttime\t\n", strings.ToUpper(by))
+	for _, u := range sorted {
+		rate := "-"
+		if n := u.hits + u.misses; n > 0 {
+			rate = fmt.Sprintf("%.1f%%", 100*float64(u.hits)/float64(n))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%d\t%s\t%s\t%s\t\n",
+			u.key, u.requests, u.hits, u.misses, rate, u.puts,
+			formatSize(u.bytesIn), formatSize(u.bytesOut), u.duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// formatSize formats n bytes with a binary unit.
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", f, units[i])
+}
+
+// runReport implements "go-cacher-server report", which sums up access
+// logs by client.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	by := fs.String("by", "client", "what to group requests by: \"client\", \"namespace\" or \"client,namespace\"")
+	since := fs.Duration("since", 0, "if set, only count requests made this long ago or later")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: go-cacher-server report [flags] [access-log ...]\n\nSums up -access-log files, or stdin, by client.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+	usages := map[string]*usage{}
+	if fs.NArg() == 0 {
+		if err := summarize(os.Stdin, *by, from, usages); err != nil {
+			return err
+		}
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = summarize(f, *by, from, usages)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return writeReport(os.Stdout, *by, usages)
+}
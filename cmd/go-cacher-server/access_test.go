@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestAccessLog(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("ci-token read,write ci\nlaptop-token read laptop\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	srv := newTestServer(t)
+	srv.auth = ta
+	srv.access = newAccessLog(&buf, nil)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ctx := context.Background()
+
+	ci := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: "ci-token"}}, false)
+	laptop := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: "laptop-token"}}, false)
+	actionID, outputID := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	require.NoError(t, ci.Put(ctx, actionID, outputID, 5, strings.NewReader("hello")))
+	_, body, err := getString(t, laptop, actionID)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", body)
+	got, _, err := getString(t, laptop, strings.Repeat("c", 64))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Entries are logged after responses are sent.
+	require.Eventually(t, func() bool {
+		srv.access.mu.Lock()
+		defer srv.access.mu.Unlock()
+		return strings.Count(buf.String(), "\n") >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	srv.access.mu.Lock()
+	logged := buf.String()
+	srv.access.mu.Unlock()
+
+	var put accessEntry
+	require.NoError(t, json.Unmarshal([]byte(strings.SplitN(logged, "\n", 2)[0]), &put))
+	assert.Equal(t, "ci", put.Client)
+	assert.Equal(t, "put", put.Endpoint)
+	assert.Equal(t, 204, put.Status)
+	assert.Equal(t, int64(5), put.BytesIn)
+
+	usages := map[string]*usage{}
+	require.NoError(t, summarize(strings.NewReader(logged), "client", time.Time{}, usages))
+	require.Contains(t, usages, "ci")
+	require.Contains(t, usages, "laptop")
+	assert.Equal(t, int64(1), usages["ci"].puts)
+	assert.Equal(t, int64(5), usages["ci"].bytesIn)
+	assert.Equal(t, int64(1), usages["laptop"].hits)
+	assert.Equal(t, int64(1), usages["laptop"].misses)
+	assert.Equal(t, int64(0), usages["laptop"].puts)
+
+	var report bytes.Buffer
+	require.NoError(t, writeReport(&report, "client", usages))
+	assert.Len(t, strings.Split(strings.TrimSpace(report.String()), "\n"), 3)
+	assert.Contains(t, report.String(), "50.0%")
+
+	assert.Error(t, summarize(strings.NewReader("not json\n"), "client", time.Time{}, usages))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const (
+	defaultAdminListLimit = 100
+	maxAdminListLimit     = 10000
+)
+
+// AdminListResponse is the JSON response of GET /admin/entries.
+type AdminListResponse struct {
+	Entries []cachers.Entry `json:"entries"`
+	// Next is the cursor of the next page, or empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// AdminStats is the JSON response of GET /admin/stats.
+type AdminStats struct {
+	Entries   int64     `json:"entries"`
+	TotalSize int64     `json:"totalSize"`
+	Oldest    time.Time `json:"oldest,omitzero"`
+	Newest    time.Time `json:"newest,omitzero"`
+	Hits      int64     `json:"hits"`
+	Misses    int64     `json:"misses"`
+	DiskBytes int64     `json:"diskBytes,omitempty"`
+	DiskFiles int64     `json:"diskFiles,omitempty"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Backend   string    `json:"backend"`
+}
+
+// entryFilter selects entries by age and size; zero fields don't filter.
+type entryFilter struct {
+	minAge, maxAge   time.Duration
+	minSize, maxSize int64
+}
+
+func parseEntryFilter(q map[string][]string) (f entryFilter, err error) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	for _, d := range []struct {
+		key string
+		dst *time.Duration
+	}{{"min_age", &f.minAge}, {"max_age", &f.maxAge}} {
+		if v := get(d.key); v != "" {
+			if *d.dst, err = time.ParseDuration(v); err != nil {
+				return f, err
+			}
+		}
+	}
+	for _, n := range []struct {
+		key string
+		dst *int64
+	}{{"min_size", &f.minSize}, {"max_size", &f.maxSize}} {
+		if v := get(n.key); v != "" {
+			if *n.dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return f, err
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f entryFilter) match(e cachers.Entry, now time.Time) bool {
+	age := now.Sub(e.Time)
+	return (f.minAge == 0 || age >= f.minAge) &&
+		(f.maxAge == 0 || age <= f.maxAge) &&
+		(f.minSize == 0 || e.Size >= f.minSize) &&
+		(f.maxSize == 0 || e.Size <= f.maxSize)
+}
+
+// handleAdmin serves the /admin/ endpoints. The caller checked the token
+// has scopeAdmin.
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	ac := s.store.Admin()
+	if ac == nil {
+		http.Error(w, "storage backend doesn't support the admin API", http.StatusNotImplemented)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin")
+	switch {
+	case path == "/entries" && r.Method == "GET":
+		s.handleAdminList(w, r, ac)
+	case strings.HasPrefix(path, "/entries/"):
+		actionID := strings.TrimPrefix(path, "/entries/")
+		if !validHex(actionID) {
+			http.Error(w, "bad action ID", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			e, ok, err := ac.Stat(r.Context(), actionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, e)
+		case "DELETE":
+			ok, err := ac.Delete(r.Context(), actionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			s.metrics.removed.Add(1)
+			// Without an evictor nothing knows whether other actions
+			// share the output; scrubs remove it once it's orphaned.
+			if outputID := s.evict.forget(actionID); outputID != "" {
+				if _, err := ac.DeleteOutput(r.Context(), outputID); err != nil {
+					log.Printf("deleting output %s: %v", outputID, err)
+				}
+				s.removeCompressedCopies(outputID)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		}
+	case path == "/purge" && r.Method == "POST":
+		var n int64
+		_ = ac.List(r.Context(), "", func(cachers.Entry) bool { n++; return true })
+		if err := ac.Purge(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.metrics.removed.Add(n)
+		s.evict.purged()
+		s.removeCompressedCopies("")
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/stats" && r.Method == "GET":
+		s.handleAdminStats(w, r, ac)
+	case path == "/scrub" && r.Method == "POST":
+		s.handleAdminScrub(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *server) handleAdminList(w http.ResponseWriter, r *http.Request, ac cachers.AdminCache) {
+	q := r.URL.Query()
+	f, err := parseEntryFilter(q)
+	if err != nil {
+		http.Error(w, "bad filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultAdminListLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxAdminListLimit)
+	}
+	res := AdminListResponse{Entries: []cachers.Entry{}}
+	now := time.Now()
+	err = ac.List(r.Context(), q.Get("cursor"), func(e cachers.Entry) bool {
+		if !f.match(e, now) {
+			return true
+		}
+		if len(res.Entries) == limit {
+			res.Next = res.Entries[limit-1].ActionID
+			return false
+		}
+		res.Entries = append(res.Entries, e)
+		return true
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *server) handleAdminStats(w http.ResponseWriter, r *http.Request, ac cachers.AdminCache) {
+	st := AdminStats{
+		Hits:     s.metrics.hits.Load(),
+		Misses:   s.metrics.misses.Load(),
+		BytesIn:  s.metrics.bytesIn.Load(),
+		BytesOut: s.metrics.bytesOut.Load(),
+		Backend:  s.store.Kind(),
+	}
+	err := ac.List(r.Context(), "", func(e cachers.Entry) bool {
+		st.Entries++
+		st.TotalSize += e.Size
+		if st.Oldest.IsZero() || e.Time.Before(st.Oldest) {
+			st.Oldest = e.Time
+		}
+		if e.Time.After(st.Newest) {
+			st.Newest = e.Time
+		}
+		return true
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.dir != "" {
+		st.DiskBytes, st.DiskFiles = s.metrics.diskUsage(s.dir)
+	}
+	writeJSON(w, st)
+}
+
+// removeCompressedCopies removes the -store-compressed copies of outputID,
+// or of all outputs if outputID is empty.
+func (s *server) removeCompressedCopies(outputID string) {
+	if s.dir == "" {
+		return
+	}
+	pattern := filepath.Join(s.dir, "z-"+outputID+"*")
+	if outputID != "" {
+		pattern = filepath.Join(s.dir, "z-"+outputID+".*")
+	}
+	names, _ := filepath.Glob(pattern)
+	for _, name := range names {
+		_ = os.Remove(name)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
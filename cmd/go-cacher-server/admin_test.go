@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestAdminAPI(t *testing.T) {
+	srv := newTestServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rw read,write\nops admin\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	srv.auth = ta
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: "rw"}}, false)
+	ctx := context.Background()
+	for i := range 5 {
+		body := strings.Repeat("x", i*10)
+		actionID := fmt.Sprintf("a%03d", i)
+		require.NoError(t, c.Put(ctx, actionID, fmt.Sprintf("b%03d", i), int64(len(body)), strings.NewReader(body)))
+	}
+
+	do := func(method, path, token string, v any) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() //nolint:errcheck
+		if v != nil && res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(v))
+		}
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, do("GET", "/admin/stats", "rw", nil))
+
+	var page AdminListResponse
+	require.Equal(t, http.StatusOK, do("GET", "/admin/entries?limit=2&min_size=10", "ops", &page))
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "a001", page.Entries[0].ActionID)
+	assert.Equal(t, "a002", page.Entries[1].ActionID)
+	assert.Equal(t, "a002", page.Next)
+	cursor := page.Next
+	page = AdminListResponse{}
+	require.Equal(t, http.StatusOK, do("GET", "/admin/entries?limit=2&min_size=10&cursor="+cursor, "ops", &page))
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, "a004", page.Entries[1].ActionID)
+	assert.Empty(t, page.Next)
+
+	var e cachers.Entry
+	require.Equal(t, http.StatusOK, do("GET", "/admin/entries/a003", "ops", &e))
+	assert.Equal(t, "b003", e.OutputID)
+	assert.Equal(t, int64(30), e.Size)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/admin/entries/a003", "ops", nil))
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/admin/entries/a003", "ops", nil))
+	outputID, _, err := getString(t, c, "a003")
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+
+	var st AdminStats
+	require.Equal(t, http.StatusOK, do("GET", "/admin/stats", "ops", &st))
+	assert.Equal(t, int64(4), st.Entries)
+	assert.Equal(t, int64(0+10+20+40), st.TotalSize)
+	assert.Equal(t, int64(1), st.Misses)
+
+	// Deleting an action keeps the output other actions share.
+	require.NoError(t, c.Put(ctx, "a005", "b004", 40, strings.NewReader(strings.Repeat("x", 40))))
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/admin/entries/a004", "ops", nil))
+	_, body, err := getString(t, c, "a005")
+	require.NoError(t, err)
+	assert.Len(t, body, 40)
+
+	assert.Equal(t, http.StatusNoContent, do("POST", "/admin/purge", "ops", nil))
+	require.Equal(t, http.StatusOK, do("GET", "/admin/stats", "ops", &st))
+	assert.Zero(t, st.Entries)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// scope is a set of permissions granted to a token.
+type scope uint8
+
+const (
+	scopeRead scope = 1 << iota
+	scopeWrite
+	scopeAdmin
+)
+
+func parseScopes(s string) (scope, error) {
+	var sc scope
+	for _, name := range strings.Split(s, ",") {
+		switch name {
+		case "read":
+			sc |= scopeRead
+		case "write":
+			sc |= scopeWrite
+		case "admin":
+			sc |= scopeAdmin
+		default:
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+	return sc, nil
+}
+
+// tokenInfo is what the server knows about a client token.
+type tokenInfo struct {
+	name      string // for logs; defaults to "token-<line>"
+	scopes    scope
+	namespace string // if set, the only namespace the token may use
+}
+
+// tokenAuth authenticates requests against a token file.
+//
+// The file has one token per line:
+//
+//	<token> <scopes> [name] [ns=<namespace>]
+//
+// where scopes is a comma separated list of "read", "write" and "admin".
+// Tokens with a namespace are confined to it, and requests carrying them
+// go to it even without a /ns/<namespace> URL prefix.
+// Blank lines and lines starting with '#' are ignored.
+type tokenAuth struct {
+	// tokens is keyed by the SHA-256 of the token so lookups don't
+	// compare secrets byte by byte.
+	tokens map[[sha256.Size]byte]*tokenInfo
+}
+
+func loadTokenFile(path string) (*tokenAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+	ta := &tokenAuth{tokens: map[[sha256.Size]byte]*tokenInfo{}}
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("%s:%d: want \"<token> <scopes> [name] [ns=<namespace>]\"", path, lineNum)
+		}
+		scopes, err := parseScopes(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		ti := &tokenInfo{name: fmt.Sprintf("token-%d", lineNum), scopes: scopes}
+		for i, f := range fields[2:] {
+			if ns, ok := strings.CutPrefix(f, "ns="); ok {
+				if !validNamespace(ns) {
+					return nil, fmt.Errorf("%s:%d: bad namespace %q", path, lineNum, ns)
+				}
+				ti.namespace = ns
+			} else if i == 0 {
+				ti.name = f
+			} else {
+				return nil, fmt.Errorf("%s:%d: unexpected %q", path, lineNum, f)
+			}
+		}
+		key := sha256.Sum256([]byte(fields[0]))
+		if _, dup := ta.tokens[key]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, lineNum)
+		}
+		ta.tokens[key] = ti
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ta.tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return ta, nil
+}
+
+// requestToken returns the token presented by r, either as a bearer token or
+// as the password of HTTP basic auth.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// lookup returns the token presented by r, or nil if there is none or it's
+// unknown.
+func (ta *tokenAuth) lookup(r *http.Request) *tokenInfo {
+	token := requestToken(r)
+	if token == "" {
+		return nil
+	}
+	return ta.tokens[sha256.Sum256([]byte(token))]
+}
+
+// authorize checks that r carries a token with the need scope.
+// Otherwise it writes a 401 or 403 response and returns nil.
+func (ta *tokenAuth) authorize(w http.ResponseWriter, r *http.Request, need scope) *tokenInfo {
+	ti := ta.lookup(r)
+	if ti == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="go-cacher-server"`)
+		// Lets browsers prompt for the token, as the password.
+		w.Header().Add("WWW-Authenticate", `Basic realm="go-cacher-server"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	if ti.scopes&need != need {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	return ti
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const (
+	// maxBatchIDs is the most action IDs accepted in one batch request.
+	maxBatchIDs = 1000
+	// maxBatchInline caps the output bytes inlined per batch entry.
+	maxBatchInline = 4 << 20
+)
+
+// batchEntry is an action found during a batch request.
+type batchEntry struct {
+	actionID string
+	outputID string
+	size     int64
+	body     io.ReadCloser
+}
+
+// readBatchRequest decodes and validates the body of a batch request.
+// On failure it writes the error response and returns false.
+func readBatchRequest(w http.ResponseWriter, r *http.Request) (br cachers.BatchRequest, ok bool) {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&br); err != nil {
+		http.Error(w, "bad batch request: "+err.Error(), http.StatusBadRequest)
+		return br, false
+	}
+	if len(br.ActionIDs) > maxBatchIDs {
+		http.Error(w, fmt.Sprintf("too many action IDs; max %d", maxBatchIDs), http.StatusBadRequest)
+		return br, false
+	}
+	for _, id := range br.ActionIDs {
+		if !validHex(id) {
+			http.Error(w, "bad action ID", http.StatusBadRequest)
+			return br, false
+		}
+	}
+	return br, true
+}
+
+// lookupBatch returns the entries of br that are in the cache.
+// The caller must closeEntries them.
+func (s *server) lookupBatch(r *http.Request, br cachers.BatchRequest) ([]batchEntry, error) {
+	var entries []batchEntry
+	seen := map[string]bool{}
+	for _, actionID := range br.ActionIDs {
+		if seen[actionID] {
+			continue
+		}
+		seen[actionID] = true
+		outputID, size, body, err := s.store.Get(r.Context(), actionID)
+		if err != nil {
+			closeEntries(entries)
+			return nil, err
+		}
+		s.lookup(r, outputID != "")
+		if outputID == "" {
+			continue
+		}
+		s.evict.accessedAction(r.Context(), actionID)
+		entries = append(entries, batchEntry{actionID: actionID, outputID: outputID, size: size, body: body})
+	}
+	return entries, nil
+}
+
+func closeEntries(entries []batchEntry) {
+	for _, e := range entries {
+		_ = e.body.Close()
+	}
+}
+
+// handleBatchExists answers POST /batch/exists with the cached subset of
+// the requested action IDs.
+func (s *server) handleBatchExists(w http.ResponseWriter, r *http.Request) {
+	br, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	entries, err := s.lookupBatch(r, br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer closeEntries(entries)
+	res := cachers.BatchExistsResponse{Entries: map[string]cachers.ActionValue{}}
+	for _, e := range entries {
+		res.Entries[e.actionID] = cachers.ActionValue{OutputID: e.outputID, Size: e.size}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&res)
+}
+
+// handleBatchGet answers POST /batch/get with a multipart/mixed stream of
+// the cached subset of the requested action IDs. See cachers.BatchRequest.
+func (s *server) handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	br, ok := readBatchRequest(w, r)
+	if !ok {
+		return
+	}
+	entries, err := s.lookupBatch(r, br)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer closeEntries(entries)
+	maxInline := min(br.MaxInline, maxBatchInline)
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for _, e := range entries {
+		if err := writeBatchPart(mw, e, maxInline); err != nil {
+			// Headers are gone; the truncated stream tells the client.
+			if s.verbose {
+				log.Printf("batch get of action %s: %v", e.actionID, err)
+			}
+			return
+		}
+	}
+	_ = mw.Close()
+}
+
+func writeBatchPart(mw *multipart.Writer, e batchEntry, maxInline int64) error {
+	h := textproto.MIMEHeader{}
+	h.Set(cachers.HeaderActionID, e.actionID)
+	h.Set(cachers.HeaderOutputID, e.outputID)
+	h.Set(cachers.HeaderOutputSize, strconv.FormatInt(e.size, 10))
+	if e.size > maxInline {
+		h.Set(cachers.HeaderOutputOmitted, "1")
+		_, err := mw.CreatePart(h)
+		return err
+	}
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(pw, e.body, e.size)
+	return err
+}
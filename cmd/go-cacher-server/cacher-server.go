@@ -10,41 +10,163 @@ Protocol:
 GET /action/<actionID-hex>
 {"outputID":"$outputID-hex","size":1234}
 
+GET /action/<actionID-hex>
+Accept: application/octet-stream
+200 of the output bytes with X-Cache-Output-Id and X-Cache-Output-Size, or 404
+
 GET /output/<outputID-hex>
 200 of those bytes with Content-Length or 404
 
+Outputs carry ETag: "<outputID>" and honor If-None-Match, Range and If-Range.
+GET /output responses are Cache-Control: immutable, action lookups no-cache.
+HEAD works on both, and action lookups always carry X-Cache-Output-Id and
+X-Cache-Output-Size.
+
 PUT /<actionID>/<outputID>
 Content-Length: 1234
 <bytes>
+413 if the output is larger than -max-upload-size or -max-object-size, 400
+if its SHA-256 isn't the output ID
+
+POST /batch/exists
+{"actionIDs":["$actionID-hex",...]}
+{"entries":{"$actionID-hex":{"outputID":"$outputID-hex","size":1234},...}}
+
+POST /batch/get
+{"actionIDs":["$actionID-hex",...],"maxInline":65536}
+multipart/mixed with one part per cached action, described by the
+X-Cache-Action-Id, X-Cache-Output-Id and X-Cache-Output-Size headers. Parts
+of outputs larger than maxInline have no body and X-Cache-Output-Omitted: 1.
+
+GET /metrics
+Prometheus metrics in the text exposition format
+
+GET /admin/entries?limit=100&cursor=<actionID>&min_age=1h&max_age=&min_size=&max_size=
+{"entries":[{"actionID":...,"outputID":...,"size":1234,"time":...},...],"next":"<cursor>"}
+
+GET /admin/entries/<actionID-hex>
+DELETE /admin/entries/<actionID-hex>
+POST /admin/purge
+GET /admin/stats
+POST /admin/scrub?dry_run=1
+Admin endpoints; they need -token-file and a token with the "admin" scope.
+
+GET /dashboard
+An HTML dashboard, fed by GET /dashboard/data. With -token-file it needs the
+"admin" scope; browsers prompt for the token as the basic auth password.
+
+With -namespaces, all of the above are also served under /ns/<namespace>/,
+from the namespace's own storage and with its own quota. Requests with a
+token confined to a namespace (ns=<namespace> in -token-file) go to that
+namespace without the prefix. GET /metrics labels samples by namespace.
+
+With -peers, puts are copied to the listed servers in the background with
+an X-Cache-Replica: 1 header, and puts carrying that header aren't copied
+further. Entries missed, for instance while a server was down, are pulled
+from the peers' GET /admin/entries every -peer-sync-interval. HTTPS peers
+are verified against -peer-tls-ca, and -peer-tls-cert and -peer-tls-key
+are presented to peers requiring client certificates.
+
+With -rate-limit, -max-inflight or -max-client-inflight, requests over a
+limit get 429 Too Many Requests with a Retry-After header.
+
+With -scrub-interval, stored outputs are periodically hashed and index
+entries checked; broken ones are removed and logged.
+
+With -access-log, each request is logged as a JSON line. "go-cacher-server
+report <access-log>..." sums those up per client.
+
+With -token-file, all requests but GET / and GET /metrics need a token with the "read"
+(GETs) or "write" (PUTs) scope, sent as "Authorization: Bearer <token>" or as
+the password of HTTP basic auth. Missing or unknown tokens get a 401, tokens
+lacking the scope a 403.
 
 */
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bradfitz/go-tool-cache/cachers"
 )
 
 var (
-	dir     = flag.String("cache-dir", "", "cache directory")
-	verbose = flag.Bool("verbose", false, "be verbose")
-	listen  = flag.String("listen", ":31364", "listen address")
-	latency = flag.Duration("inject-latency", 0, "the additional latency to add to all requests (for testing)")
+	dir       = flag.String("cache-dir", "", "cache directory for the disk backends")
+	backend   = flag.String("backend", "disk", "storage backend: \"disk\", \"s3\" or \"disk+s3\" (disk in front of S3)")
+	s3Bucket  = flag.String("s3-bucket", "", "S3 bucket for the s3 backends; credentials come from the AWS SDK's default chain")
+	s3Region  = flag.String("s3-region", "", "AWS region of -s3-bucket, if not configured in the environment")
+	s3Prefix  = flag.String("s3-prefix", "go-cacher-server", "key prefix in -s3-bucket")
+	upstream  = flag.String("upstream", "", "if set, serve as a pull-through proxy of this go-cacher-server (\"https://host:port\") or S3 bucket (\"s3://bucket/prefix\"); needs -backend=disk")
+	upWrite   = flag.String("upstream-write", "through", "how puts reach -upstream: \"through\" (before answering), \"back\" (in the background) or \"none\"")
+	upToken   = flag.String("upstream-token-file", "", "file holding the bearer token for an HTTP -upstream")
+	verbose   = flag.Bool("verbose", false, "be verbose")
+	listen    = flag.String("listen", ":31364", "listen address, or \"unix:<path>\" or \"unix://<path>\" for a Unix socket")
+	sockMode  = flag.String("socket-mode", "0660", "permissions of a -listen Unix socket, in octal")
+	latency   = flag.Duration("inject-latency", 0, "the additional latency to add to all requests (for testing)")
+	tokenFile = flag.String("token-file", "", "if set, require tokens listed in this file; lines are \"<token> <read,write,admin> [name] [ns=<namespace>]\"")
+	tlsCert   = flag.String("tls-cert", "", "if set with -tls-key, serve HTTPS using this PEM certificate; reloaded when it changes")
+	tlsKey    = flag.String("tls-key", "", "PEM private key for -tls-cert")
+	clientCA  = flag.String("tls-client-ca", "", "if set, require client certificates signed by a CA in this PEM bundle")
+	compress  = flag.String("compression", "gzip", "comma separated transfer compressions to offer; empty disables compression")
+	maxSize   = flag.String("max-size", "", "if set, evict outputs to keep the cache below this size, like \"50GiB\"; needs a disk backend")
+	maxObject = flag.String("max-object-size", "", "reject outputs larger than this with 413; defaults to -max-size")
+	policy    = flag.String("evict-policy", evictLRU, "which outputs -max-size evicts first: \"lru\" (least recently used) or \"lfu\" (least frequently used)")
+	highWater = flag.Float64("high-watermark", 0.95, "fraction of -max-size at which eviction starts")
+	lowWater  = flag.Float64("low-watermark", 0.85, "fraction of -max-size eviction frees space down to")
+	nsFile    = flag.String("namespaces", "", "if set, serve the namespaces listed in this file besides the default one; lines are \"<namespace> [max-size=<size>] [max-object-size=<size>]\"")
+	verifyOut = flag.Bool("verify-outputs", true, "reject uploads whose SHA-256 doesn't match their output ID")
+	storeComp = flag.Bool("store-compressed", false, "keep compressed copies of outputs on disk instead of compressing per request")
+	peers     = flag.String("peers", "", "comma separated base URLs or unix:<path> sockets of other servers to replicate puts to and sync missed entries from")
+	peerToken = flag.String("peer-token-file", "", "file holding the bearer token for -peers; needs read, write and admin scope")
+	peerCA    = flag.String("peer-tls-ca", "", "PEM bundle of extra CAs to verify HTTPS -peers with")
+	peerCert  = flag.String("peer-tls-cert", "", "if set with -peer-tls-key, PEM client certificate to present to -peers")
+	peerKey   = flag.String("peer-tls-key", "", "PEM private key for -peer-tls-cert")
+	peerSync  = flag.Duration("peer-sync-interval", 10*time.Minute, "how often to pull entries missed from -peers; 0 disables it")
+	rateLimit = flag.Float64("rate-limit", 0, "if set, requests per second allowed per client (token name or IP); more get 429")
+	rateBurst = flag.Int("rate-burst", 0, "requests a client may make at once above -rate-limit; defaults to -rate-limit")
+	bandwidth = flag.String("bandwidth-limit", "", "if set, body bytes per second per client, like \"50MiB\"; faster transfers are slowed down")
+	inflight  = flag.Int("max-inflight", 0, "if set, requests served at once; more get 429")
+	clientInf = flag.Int("max-client-inflight", 0, "if set, requests served at once per client; more get 429")
+	maxUpload = flag.String("max-upload-size", "4GiB", "reject uploads larger than this with 413; 0 disables the limit")
+	hdrTime   = flag.Duration("read-header-timeout", 10*time.Second, "how long clients may take to send request headers")
+	readTime  = flag.Duration("read-timeout", 10*time.Minute, "how long clients may take to send a whole request, including the body; 0 disables it")
+	writeTime = flag.Duration("write-timeout", 10*time.Minute, "how long writing a response may take; 0 disables it")
+	idleTime  = flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	drain     = flag.Duration("shutdown-timeout", 30*time.Second, "how long to let in-flight requests finish on SIGTERM or SIGINT")
+	scrubInt  = flag.Duration("scrub-interval", 0, "if set, check the stored outputs' hashes and index entries this often, removing broken ones; needs a disk backend")
+	scrubRate = flag.String("scrub-rate", "50MiB", "output bytes per second a scrub hashes")
+	staleAge  = flag.Duration("stale-temp-age", time.Hour, "on start, remove temp files of interrupted writes older than this and index entries whose outputs are missing; negative disables it")
+	accessLg  = flag.String("access-log", "", "if set, append a JSON line per request to this file, or write them to stdout if \"-\"; see \"go-cacher-server report\"")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	flag.Parse()
-	if *dir == "" {
+	ctx, cancel := context.WithCancel(context.Background())
+	usesDisk := *backend == "disk" || *backend == "disk+s3"
+	if *dir == "" && usesDisk {
 		d, err := os.UserCacheDir()
 		if err != nil {
 			log.Fatal(err)
@@ -53,39 +175,321 @@ func main() {
 		log.Printf("Defaulting to cache dir %v ...", d)
 		*dir = d
 	}
-	if err := os.MkdirAll(*dir, 0755); err != nil {
-		log.Fatal(err)
+	if !usesDisk {
+		*dir = ""
 	}
 
-	dc := cachers.NewSimpleDiskCache(*verbose, *dir)
-
-	srv := &server{
-		cache:   dc,
-		verbose: *verbose,
-		latency: *latency,
+	opts := storageOptions{
+		Backend:       *backend,
+		Dir:           *dir,
+		S3Bucket:      *s3Bucket,
+		S3Region:      *s3Region,
+		S3Prefix:      *s3Prefix,
+		Upstream:      *upstream,
+		UpstreamWrite: *upWrite,
+		Verbose:       *verbose,
+	}
+	if *upToken != "" {
+		token, err := cachers.ReadTokenFile(*upToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.UpstreamAuth = cachers.BearerTokenAuth{Token: token}
+	}
+	comps, err := parseCompressions(*compress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *storeComp && *dir == "" {
+		log.Fatal("-store-compressed needs a disk backend")
+	}
+	repOpts := replicatorOptions{SyncInterval: *peerSync, Verbose: *verbose}
+	if *peers != "" {
+		repOpts.Peers = strings.Split(*peers, ",")
+	}
+	if *peerToken != "" {
+		token, err := cachers.ReadTokenFile(*peerToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		repOpts.Auth = cachers.BearerTokenAuth{Token: token}
+	}
+	if *peerCA != "" || *peerCert != "" || *peerKey != "" {
+		repOpts.TLSConfig, err = cachers.NewClientTLSConfig(*peerCA, *peerCert, *peerKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	limOpts := limiterOptions{
+		Rate:              *rateLimit,
+		Burst:             *rateBurst,
+		MaxInflight:       *inflight,
+		MaxClientInflight: *clientInf,
+	}
+	if *bandwidth != "" {
+		if limOpts.Bandwidth, err = parseSize(*bandwidth); err != nil {
+			log.Fatalf("-bandwidth-limit: %v", err)
+		}
+	}
+	limits := newLimiter(limOpts)
+	var uploadLimit int64
+	if *maxUpload != "0" {
+		if uploadLimit, err = parseSize(*maxUpload); err != nil {
+			log.Fatalf("-max-upload-size: %v", err)
+		}
+	}
+	var scrubBytes int64
+	if scrubBytes, err = parseSize(*scrubRate); err != nil {
+		log.Fatalf("-scrub-rate: %v", err)
+	}
+	var access *accessLog
+	if *accessLg != "" {
+		if access, err = openAccessLog(*accessLg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var auth *tokenAuth
+	if *tokenFile != "" {
+		auth, err = loadTokenFile(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	newServer := func(nc namespaceConfig) *server {
+		opts := opts
+		opts.Namespace = nc.name
+		store, err := newStorage(ctx, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.Start(ctx); err != nil {
+			log.Fatal(err)
+		}
+		srv := &server{
+			namespace:       nc.name,
+			store:           store,
+			dir:             namespaceDir(*dir, nc.name),
+			verbose:         *verbose,
+			latency:         *latency,
+			auth:            auth,
+			compressions:    comps,
+			storeCompressed: *storeComp,
+			verifyOutputs:   *verifyOut,
+			limits:          limits,
+			maxUpload:       uploadLimit,
+			access:          access,
+			scrubRate:       scrubBytes,
+			staleTempAge:    *staleAge,
+		}
+		if nc.maxSize != "" {
+			srv.evict, err = newStoreEvictor(ctx, srv, nc.maxSize, nc.maxObjectSize)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		srv.replicas = newReplicator(srv, repOpts)
+		srv.replicas.start(ctx)
+		if *scrubInt > 0 {
+			if _, ok := store.Admin().(cachers.Scrubber); !ok {
+				log.Fatal("-scrub-interval needs a disk backend")
+			}
+		}
+		srv.startLoops(ctx, *scrubInt)
+		return srv
+	}
+	srv := newServer(namespaceConfig{maxSize: *maxSize, maxObjectSize: *maxObject})
+	servers := []*server{srv}
+	var handler http.Handler = srv
+	if *nsFile != "" {
+		nss, err := loadNamespaces(*nsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rt := &router{def: srv, namespaces: map[string]*server{}, auth: auth}
+		for _, nc := range nss {
+			// Unless overridden, each namespace gets the default quota of its own.
+			nc.maxSize = cmp.Or(nc.maxSize, *maxSize)
+			nc.maxObjectSize = cmp.Or(nc.maxObjectSize, *maxObject)
+			ns := newServer(nc)
+			servers = append(servers, ns)
+			rt.namespaces[nc.name] = ns
+		}
+		handler = rt
 	}
 
-	log.Fatal(http.ListenAndServe(*listen, srv))
+	hs := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: *hdrTime,
+		ReadTimeout:       *readTime,
+		WriteTimeout:      *writeTime,
+		IdleTimeout:       *idleTime,
+	}
+	mode, err := strconv.ParseUint(*sockMode, 8, 32)
+	if err != nil {
+		log.Fatalf("-socket-mode: %v", err)
+	}
+	ln, err := listenOn(*listen, fs.FileMode(mode))
+	if err != nil {
+		log.Fatal(err)
+	}
+	serve := func() error { return hs.Serve(ln) }
+	if *tlsCert == "" && *tlsKey == "" {
+		if *clientCA != "" {
+			log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+		}
+	} else {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-cert and -tls-key must be set together")
+		}
+		hs.TLSConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve = func() error { return hs.ServeTLS(ln, "", "") }
+	}
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := runServer(sigCtx, hs, serve, *drain); err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range servers {
+		s.close(*drain)
+	}
+	if err := access.close(); err != nil {
+		log.Printf("closing access log: %v", err)
+	}
+	cancel()
 }
 
 type server struct {
-	cache   *cachers.SimpleDiskCache // TODO: add interface for things other than disk cache? when needed.
-	verbose bool
-	latency time.Duration
+	namespace string // empty for the default namespace
+	store     storage
+	dir       string // local disk directory of store, or empty
+	verbose   bool
+	latency   time.Duration
+	auth      *tokenAuth // or nil if no auth is required
+
+	compressions    []*cachers.Compression // offered transfer compressions, in preference order
+	storeCompressed bool                   // keep compressed copies, see storeCompressedCopy
+	verifyOutputs   bool                   // check outputs hash to their output IDs, see verifyingReader
+	maxUpload       int64                  // largest output accepted, or 0 for no limit
+	scrubRate       int64                  // output bytes hashed per second by scrubs, or 0 for no limit
+	staleTempAge    time.Duration          // age of the temp files repair removes, negative to not repair
+
+	metrics  metrics
+	activity activity    // for the dashboard
+	evict    *evictor    // or nil without -max-size
+	replicas *replicator // or nil without -peers
+	limits   *limiter    // shared by all namespaces, or nil without limits
+	access   *accessLog  // shared by all namespaces, or nil without -access-log
+
+	scrubbing   sync.Mutex         // held while scrubbing
+	compressing sync.WaitGroup     // background storeCompressedCopy calls
+	stopLoops   context.CancelFunc // stops the loops of startLoops, or nil
+	loops       sync.WaitGroup
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: w}
+	mr := &metricsReader{ReadCloser: r.Body}
+	r.Body = mr
+	r, lc := s.withLookupCounts(r)
+	defer func() {
+		code := mw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		d := time.Since(start)
+		client := s.clientName(r)
+		s.metrics.observe(endpoint(r), code, d, mr.read, mw.written)
+		s.activity.request(client, mr.read, mw.written)
+		if lc != nil {
+			s.access.log(&accessEntry{
+				Time:       start,
+				Client:     client,
+				Namespace:  s.namespace,
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Endpoint:   endpoint(r),
+				Status:     code,
+				BytesIn:    mr.read,
+				BytesOut:   mw.written,
+				DurationMS: float64(d.Microseconds()) / 1000,
+				Hits:       lc.hits.Load(),
+				Misses:     lc.misses.Load(),
+				Replica:    r.Header.Get(headerReplica) != "",
+			})
+		}
+	}()
+	lw, r, done, ok := s.limitRequest(mw, r)
+	if !ok {
+		return
+	}
+	defer done()
+	s.serve(lw, r)
+}
+
+func (s *server) serve(w http.ResponseWriter, r *http.Request) {
 	if s.latency > 0 {
 		time.Sleep(s.latency)
 	}
 	if s.verbose {
 		log.Printf("%s %s", r.Method, r.RequestURI)
 	}
+	if len(s.compressions) > 0 {
+		names := make([]string, len(s.compressions))
+		for i, comp := range s.compressions {
+			names[i] = comp.Name
+		}
+		w.Header().Set(cachers.HeaderAcceptEncoding, strings.Join(names, ", "))
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		if s.auth == nil {
+			http.Error(w, "the admin API needs -token-file", http.StatusForbidden)
+			return
+		}
+		if s.authorize(w, r, scopeAdmin) {
+			s.handleAdmin(w, r)
+		}
+		return
+	}
+	if r.URL.Path == "/dashboard" || r.URL.Path == "/dashboard/data" {
+		if r.Method != "GET" {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.auth == nil || s.authorize(w, r, scopeAdmin) {
+			s.handleDashboard(w, r)
+		}
+		return
+	}
+	if s.auth != nil && r.URL.Path != "/" && r.URL.Path != "/metrics" {
+		need := scopeRead
+		if r.Method == "PUT" {
+			need = scopeWrite
+		}
+		if !s.authorize(w, r, need) {
+			return
+		}
+	}
 	if r.Method == "PUT" {
 		s.handlePut(w, r)
 		return
 	}
-	if r.Method != "GET" {
+	if r.Method == "POST" {
+		switch r.URL.Path {
+		case "/batch/exists":
+			s.handleBatchExists(w, r)
+		case "/batch/get":
+			s.handleBatchGet(w, r)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
 		http.Error(w, "bad method", http.StatusBadRequest)
 		return
 	}
@@ -94,6 +498,8 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleGetAction(w, r)
 	case strings.HasPrefix(r.URL.Path, "/output/"):
 		s.handleGetOutput(w, r)
+	case r.URL.Path == "/metrics":
+		s.handleMetrics(w, r)
 	case r.URL.Path == "/":
 		_, _ = io.WriteString(w, "hi")
 	default:
@@ -131,39 +537,82 @@ func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	outputID, diskPath, err := s.cache.Get(ctx, actionID)
+	outputID, size, body, err := s.store.Get(ctx, actionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if r.Header.Get("Range") == "" {
+		// Ranged downloads of one output take several requests, which
+		// mustn't count as several lookups.
+		s.lookup(r, outputID != "")
+	}
 	if outputID == "" {
 		http.Error(w, "not found ()", http.StatusNotFound)
 		return
 	}
-	fi, err := os.Stat(diskPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "not found (post-stat)", http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	s.evict.accessedAction(ctx, actionID)
+	defer body.Close() //nolint:errcheck
+	h := w.Header()
+	h.Add("Vary", "Accept")
+	h.Set(cachers.HeaderOutputID, outputID)
+	h.Set(cachers.HeaderOutputSize, strconv.FormatInt(size, 10))
+	// Actions can be overwritten, so caches must revalidate them.
+	s.setCacheControl(w, false)
+	if acceptsOutput(r) {
+		s.serveLookup(w, r, outputID, body, size)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	if r.Method == "HEAD" {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(&cachers.ActionValue{
 		OutputID: outputID,
-		Size:     fi.Size(),
+		Size:     size,
 	})
 }
 
+// acceptsOutput reports whether the client asked for a single round-trip
+// lookup, see cachers.ContentTypeOutput.
+func acceptsOutput(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(v, ",") {
+			mt, _, _ = strings.Cut(mt, ";")
+			if strings.TrimSpace(mt) == cachers.ContentTypeOutput {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveLookup answers GET /action with the output bytes themselves.
+func (s *server) serveLookup(w http.ResponseWriter, r *http.Request, outputID string, body io.Reader, size int64) {
+	w.Header().Set("Content-Type", cachers.ContentTypeOutput)
+	s.writeOutput(w, r, outputID, body, size)
+}
+
 func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request) {
 	outputID, ok := getHexSuffix(r, "/output/")
 	if !ok {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
+	size, body, err := s.store.GetOutput(r.Context(), outputID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if body == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.evict.accessedOutput(r.Context(), outputID)
+	defer body.Close() //nolint:errcheck
 	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, OutputFilename(*dir, outputID))
+	s.setCacheControl(w, true)
+	s.writeOutput(w, r, outputID, body, size)
 }
 
 func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
@@ -177,28 +626,64 @@ func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad URI", http.StatusBadRequest)
 		return
 	}
-	if r.ContentLength == -1 {
-		http.Error(w, "missing Content-Length", http.StatusBadRequest)
+	body, size, ok := s.putBody(w, r)
+	if !ok {
+		return
+	}
+	if s.maxUpload > 0 && size > s.maxUpload {
+		http.Error(w, fmt.Sprintf("output of %d bytes exceeds the maximum upload size of %d bytes", size, s.maxUpload), http.StatusRequestEntityTooLarge)
+		return
+	}
+	err := s.storeOutput(ctx, actionID, outputID, size, body)
+	if errors.Is(err, errTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errOutputMismatch) {
+		s.rejectPut(w, r, actionID, outputID, err)
 		return
 	}
-	_, err := s.cache.Put(ctx, actionID, outputID, r.ContentLength, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if r.Header.Get(headerReplica) == "" {
+		s.replicas.replicate(actionID, outputID)
+	}
+	s.activity.put(putRecord{
+		Time:     time.Now(),
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     size,
+		Client:   s.clientName(r),
+	})
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func OutputFilename(dir, outputID string) string {
-	if len(outputID) < 4 || len(outputID) > 1000 {
-		return ""
+// storeOutput stores an output like a put from a client would, checked
+// against the maximum object size and, with verifyOutputs, the output ID.
+func (s *server) storeOutput(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	done, err := s.evict.admit(actionID, outputID, size)
+	if err != nil {
+		return err
 	}
-	for i := range outputID {
-		b := outputID[i]
-		if b >= '0' && b <= '9' || b >= 'a' && b <= 'f' {
-			continue
+	defer done()
+	if s.verifyOutputs {
+		vr := newVerifyingReader(body, outputID, size)
+		if size == 0 {
+			if err := vr.check(); err != io.EOF {
+				return err
+			}
 		}
-		return ""
+		body = vr
+	}
+	diskPath, err := s.store.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return err
+	}
+	s.evict.added(actionID, outputID, size)
+	if s.storeCompressed && diskPath != "" {
+		s.storeCompressedCopy(outputID, diskPath, size)
 	}
-	return filepath.Join(dir, fmt.Sprintf("o-%s", outputID))
+	return nil
 }
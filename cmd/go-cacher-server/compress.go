@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// parseCompressions returns the compressions named in the comma separated
+// list s.
+func parseCompressions(s string) ([]*cachers.Compression, error) {
+	var comps []*cachers.Compression
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		comp := cachers.LookupCompression(name)
+		if comp == nil {
+			return nil, fmt.Errorf("unknown compression %q", name)
+		}
+		comps = append(comps, comp)
+	}
+	return comps, nil
+}
+
+// lookupCompression returns the offered compression called name, or nil.
+func (s *server) lookupCompression(name string) *cachers.Compression {
+	for _, comp := range s.compressions {
+		if comp.Name == name {
+			return comp
+		}
+	}
+	return nil
+}
+
+// pickCompression returns the compression to send an output of size bytes
+// with, or nil to send it as is. HEAD and Range requests get it as is.
+func (s *server) pickCompression(r *http.Request, size int64) *cachers.Compression {
+	if size < cachers.MinCompressSize || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+		return nil
+	}
+	accept := r.Header.Get("Accept-Encoding")
+	for _, comp := range s.compressions {
+		if cachers.AcceptsEncoding(accept, comp.Name) {
+			return comp
+		}
+	}
+	return nil
+}
+
+// compressedFilename is where -store-compressed keeps the compressed
+// representation of an output.
+func compressedFilename(dir, outputID string, comp *cachers.Compression) string {
+	return filepath.Join(dir, fmt.Sprintf("z-%s.%s", outputID, comp.Name))
+}
+
+// writeOutput writes the size bytes of output outputID from body, compressed
+// if the client accepts a compression and the output is worth compressing.
+// Uncompressed responses carry a Content-Length and honor Range requests.
+// All carry an ETag and honor If-None-Match.
+func (s *server) writeOutput(w http.ResponseWriter, r *http.Request, outputID string, body io.Reader, size int64) {
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("Accept-Ranges", "bytes")
+	comp := s.pickCompression(r, size)
+	var stored *os.File
+	if comp != nil && s.storeCompressed {
+		f, err := os.Open(compressedFilename(s.dir, outputID, comp))
+		if err == nil {
+			stored = f
+			defer f.Close() //nolint:errcheck
+		} else {
+			// Not stored compressed because it didn't compress well.
+			comp = nil
+		}
+	}
+	compName := ""
+	if comp != nil {
+		compName = comp.Name
+	}
+	etag := outputETag(outputID, compName)
+	h.Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if stored != nil {
+		if fi, err := stored.Stat(); err == nil {
+			h.Set("Content-Encoding", comp.Name)
+			h.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+			_, _ = io.Copy(w, stored)
+			return
+		}
+	}
+	if comp == nil {
+		start, length, partial, handled := requestedRange(w, r, etag, size)
+		if handled {
+			return
+		}
+		if partial {
+			if err := skip(body, start); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+			h.Set("Content-Length", strconv.FormatInt(length, 10))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			length = size
+			h.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err := io.CopyN(w, body, length); err != nil && s.verbose {
+			log.Printf("writing output %s: %v", outputID, err)
+		}
+		return
+	}
+	h.Set("Content-Encoding", comp.Name)
+	zw := comp.NewWriter(w)
+	_, err := io.CopyN(zw, body, size)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil && s.verbose {
+		log.Printf("writing %s output %s: %v", comp.Name, outputID, err)
+	}
+}
+
+// putBody returns the uncompressed body and size of a PUT request.
+// On failure it writes the error response and returns ok false.
+func (s *server) putBody(w http.ResponseWriter, r *http.Request) (body io.Reader, size int64, ok bool) {
+	enc := r.Header.Get("Content-Encoding")
+	if enc == "" {
+		if r.ContentLength == -1 {
+			http.Error(w, "missing Content-Length", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		return r.Body, r.ContentLength, true
+	}
+	comp := s.lookupCompression(enc)
+	if comp == nil {
+		http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return nil, 0, false
+	}
+	size, err := strconv.ParseInt(r.Header.Get(cachers.HeaderOutputSize), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "compressed PUT needs "+cachers.HeaderOutputSize, http.StatusBadRequest)
+		return nil, 0, false
+	}
+	zr, err := comp.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "bad "+enc+" body: "+err.Error(), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	// One byte over size lets the cache notice oversized bodies.
+	return io.LimitReader(zr, size+1), size, true
+}
+
+// compressSlots limits how many compressed copies are written at once.
+var compressSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// storeCompressedCopy keeps a compressed representation of the output at
+// diskPath in s.dir for writeOutput, unless it doesn't compress well.
+// The copy is written in the background so the PUT is answered first;
+// until it exists writeOutput compresses on the fly.
+func (s *server) storeCompressedCopy(outputID, diskPath string, size int64) {
+	if size < cachers.MinCompressSize {
+		return
+	}
+	s.compressing.Add(1)
+	go func() {
+		defer s.compressing.Done()
+		compressSlots <- struct{}{}
+		defer func() { <-compressSlots }()
+		for _, comp := range s.compressions {
+			dest := compressedFilename(s.dir, outputID, comp)
+			n, err := writeCompressedCopy(comp, dest, diskPath, size)
+			if err != nil {
+				log.Printf("storing %s copy of output %s: %v", comp.Name, outputID, err)
+				continue
+			}
+			if _, err := os.Stat(diskPath); os.IsNotExist(err) {
+				// Evicted or deleted while we compressed it.
+				_ = os.Remove(dest)
+				continue
+			}
+			s.evict.grew(outputID, n)
+		}
+	}()
+}
+
+// writeCompressedCopy writes the compressed copy dest of the output at
+// diskPath. It returns the bytes written, which are zero if dest already
+// exists or the output doesn't compress well.
+func writeCompressedCopy(comp *cachers.Compression, dest, diskPath string, size int64) (n int64, err error) {
+	if _, err := os.Stat(dest); err == nil {
+		return 0, nil
+	}
+	src, err := os.Open(diskPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close() //nolint:errcheck
+	tf, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tf.Close()
+		if err != nil {
+			_ = os.Remove(tf.Name())
+		}
+	}()
+	zw := comp.NewWriter(tf)
+	if _, err = io.CopyN(zw, src, size); err != nil {
+		return 0, err
+	}
+	if err = zw.Close(); err != nil {
+		return 0, err
+	}
+	fi, err := tf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() > size*9/10 {
+		// Not worth it; writeOutput sends the output as is.
+		_ = tf.Close()
+		return 0, os.Remove(tf.Name())
+	}
+	if err = tf.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tf.Name(), dest); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// compressedSize returns the bytes of the compressed copies of outputID.
+func (s *server) compressedSize(outputID string) int64 {
+	var n int64
+	for _, comp := range s.compressions {
+		if fi, err := os.Stat(compressedFilename(s.dir, outputID, comp)); err == nil {
+			n += fi.Size()
+		}
+	}
+	return n
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+const (
+	// dashboardSampleInterval is how often the dashboard's time series
+	// are sampled, and dashboardSamples how many samples they keep.
+	dashboardSampleInterval = 30 * time.Second
+	dashboardSamples        = 240
+
+	recentPutsKept   = 50
+	topClientsShown  = 20
+	largestShown     = 20
+	maxClientsKept   = 10000
+	largestCacheTime = time.Minute
+)
+
+// activity is what the dashboard shows beyond the metrics. The zero value
+// is ready to use.
+type activity struct {
+	mu       sync.Mutex
+	samples  []sample                // oldest first, at most dashboardSamples
+	puts     []putRecord             // most recent last, at most recentPutsKept
+	clients  map[string]*clientStats // by token name or IP address
+	largest  []cachers.Entry
+	largestT time.Time // when largest was computed
+}
+
+// sample is a point of the dashboard's time series. Counters are
+// cumulative; the dashboard turns them into rates.
+type sample struct {
+	Time      time.Time `json:"time"`
+	Hits      int64     `json:"hits"`
+	Misses    int64     `json:"misses"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Removed   int64     `json:"removed"`
+	DiskBytes int64     `json:"diskBytes"`
+}
+
+type putRecord struct {
+	Time     time.Time `json:"time"`
+	ActionID string    `json:"actionID"`
+	OutputID string    `json:"outputID"`
+	Size     int64     `json:"size"`
+	Client   string    `json:"client"`
+}
+
+type clientStats struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+}
+
+// dashboardData is the JSON served at /dashboard/data.
+type dashboardData struct {
+	Now     time.Time       `json:"now"`
+	Backend string          `json:"backend"`
+	Current sample          `json:"current"`
+	Samples []sample        `json:"samples"`
+	Puts    []putRecord     `json:"puts"`
+	Clients []clientStats   `json:"clients"`
+	Largest []cachers.Entry `json:"largest"`
+}
+
+// clientName names the client of r for the dashboard: its token's name,
+// its IP address or, on a Unix socket, its user, see peerName.
+func (s *server) clientName(r *http.Request) string {
+	if s.auth != nil {
+		if ti := s.auth.lookup(r); ti != nil {
+			return ti.name
+		}
+	}
+	if strings.HasPrefix(r.RemoteAddr, "unix:") {
+		return peerName(r.RemoteAddr)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+			// Unix socket peers are unnamed.
+			return "unix"
+		}
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// request records a finished request of client.
+func (a *activity) request(client string, in, out int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clients == nil {
+		a.clients = map[string]*clientStats{}
+	}
+	cs := a.clients[client]
+	if cs == nil {
+		if len(a.clients) >= maxClientsKept {
+			client = "other"
+			cs = a.clients[client]
+		}
+		if cs == nil {
+			cs = &clientStats{Name: client}
+			a.clients[client] = cs
+		}
+	}
+	cs.Requests++
+	cs.BytesIn += in
+	cs.BytesOut += out
+}
+
+func (a *activity) put(p putRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.puts) == recentPutsKept {
+		a.puts = append(a.puts[:0], a.puts[1:]...)
+	}
+	a.puts = append(a.puts, p)
+}
+
+func (a *activity) addSample(sm sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.samples) == dashboardSamples {
+		a.samples = append(a.samples[:0], a.samples[1:]...)
+	}
+	a.samples = append(a.samples, sm)
+}
+
+// currentSample returns the current values of the dashboard's series.
+func (s *server) currentSample() sample {
+	sm := sample{
+		Time:     time.Now(),
+		Hits:     s.metrics.hits.Load(),
+		Misses:   s.metrics.misses.Load(),
+		BytesIn:  s.metrics.bytesIn.Load(),
+		BytesOut: s.metrics.bytesOut.Load(),
+		Removed:  s.metrics.removed.Load(),
+	}
+	if s.dir != "" {
+		sm.DiskBytes, _ = s.metrics.diskUsage(s.dir)
+	}
+	return sm
+}
+
+// sampleLoop samples the dashboard's time series until ctx is done.
+func (s *server) sampleLoop(ctx context.Context) {
+	t := time.NewTicker(dashboardSampleInterval)
+	defer t.Stop()
+	for {
+		s.activity.addSample(s.currentSample())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// largestEntries returns the largest cached entries, recomputed at most
+// every largestCacheTime as it reads every entry.
+func (s *server) largestEntries(ctx context.Context) []cachers.Entry {
+	ac := s.store.Admin()
+	if ac == nil {
+		return nil
+	}
+	a := &s.activity
+	a.mu.Lock()
+	if time.Since(a.largestT) < largestCacheTime {
+		defer a.mu.Unlock()
+		return a.largest
+	}
+	a.mu.Unlock()
+
+	var largest []cachers.Entry
+	err := ac.List(ctx, "", func(e cachers.Entry) bool {
+		if len(largest) < largestShown {
+			largest = append(largest, e)
+			sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+		} else if e.Size > largest[len(largest)-1].Size {
+			largest[len(largest)-1] = e
+			sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+		}
+		return true
+	})
+	if err != nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.largest, a.largestT = largest, time.Now()
+	return largest
+}
+
+func (s *server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/dashboard" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardHTML)
+		return
+	}
+	data := dashboardData{
+		Now:     time.Now(),
+		Backend: s.store.Kind(),
+		Current: s.currentSample(),
+		Largest: s.largestEntries(r.Context()),
+	}
+	a := &s.activity
+	a.mu.Lock()
+	data.Samples = append([]sample(nil), a.samples...)
+	data.Puts = append([]putRecord(nil), a.puts...)
+	for _, cs := range a.clients {
+		data.Clients = append(data.Clients, *cs)
+	}
+	a.mu.Unlock()
+	sort.Slice(data.Clients, func(i, j int) bool { return data.Clients[i].Requests > data.Clients[j].Requests })
+	if len(data.Clients) > topClientsShown {
+		data.Clients = data.Clients[:topClientsShown]
+	}
+	writeJSON(w, data)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestDashboard(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	ctx := context.Background()
+	require.NoError(t, c.Put(ctx, testActionID, testOutputID, 5, strings.NewReader("hello")))
+	require.NoError(t, c.Put(ctx, "cccc", "dddd", 2, strings.NewReader("hi")))
+	srv.activity.addSample(srv.currentSample())
+
+	res, err := http.Get(ts.URL + "/dashboard")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(b), "<title>go-cacher-server</title>")
+
+	res, err = http.Get(ts.URL + "/dashboard/data")
+	require.NoError(t, err)
+	defer res.Body.Close() //nolint:errcheck
+	var data dashboardData
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&data))
+	assert.Equal(t, "disk", data.Backend)
+	assert.Len(t, data.Samples, 1)
+	require.Len(t, data.Puts, 2)
+	assert.Equal(t, "127.0.0.1", data.Puts[0].Client)
+	require.Len(t, data.Largest, 2)
+	assert.Equal(t, testActionID, data.Largest[0].ActionID)
+	require.NotEmpty(t, data.Clients)
+	assert.Equal(t, "127.0.0.1", data.Clients[0].Name)
+	assert.Equal(t, int64(7), data.Current.BytesIn)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// Eviction policies.
+const (
+	evictLRU = "lru" // least recently accessed outputs first
+	evictLFU = "lfu" // least often accessed outputs first, then least recently
+)
+
+// touchInterval is how often an output's access time is written to disk.
+// Access times are recorded in memory on every access.
+const touchInterval = time.Minute
+
+// evictorOptions configures newEvictor.
+type evictorOptions struct {
+	MaxSize       int64   // bytes of outputs to keep at most
+	HighWatermark float64 // evict once outputs exceed this fraction of MaxSize
+	LowWatermark  float64 // down to this fraction of MaxSize
+	MaxObjectSize int64   // largest output admitted
+	Policy        string  // evictLRU or evictLFU
+	Verbose       bool
+}
+
+// evictor keeps a cache below a capacity limit by removing outputs, and
+// all actions resolving to them, when the cache grows past the high
+// watermark. It tracks sizes and accesses in memory; access times
+// survive restarts through AdminCache.Touch, access counts don't.
+// A nil *evictor admits everything and tracks nothing.
+type evictor struct {
+	ac   cachers.AdminCache
+	opts evictorOptions
+	// removed is called with the number of actions evicted.
+	removed func(n int64)
+	// extraSize, if set, returns the bytes kept alongside an output, like
+	// its compressed copies, which count toward the output's size.
+	extraSize func(outputID string) int64
+	// outputEvicted, if set, is called with each evicted output to remove
+	// what's kept alongside it.
+	outputEvicted func(outputID string)
+
+	mu      sync.Mutex
+	outputs map[string]*trackedOutput // by outputID
+	actions map[string]string         // actionID => outputID
+	total   int64                     // bytes of all outputs
+	running bool                      // an eviction is in progress
+	closed  bool                      // no more evictions are started
+
+	evicting sync.WaitGroup // the running eviction
+
+	// storing counts the puts in progress by their action and output IDs,
+	// which evictions skip, and removing holds the IDs the running
+	// eviction removes, which puts wait for. That way a put is never
+	// removed by an eviction that picked its IDs before it was stored.
+	storing      map[string]int
+	removing     map[string]bool
+	removingDone *sync.Cond // broadcast when removing shrinks; uses mu
+}
+
+type trackedOutput struct {
+	id       string
+	size     int64
+	accessed time.Time
+	touched  time.Time // when accessed was last written to disk
+	hits     int64
+	actions  map[string]bool
+}
+
+func newEvictor(ac cachers.AdminCache, opts evictorOptions, removed func(int64)) (*evictor, error) {
+	switch {
+	case opts.MaxSize <= 0:
+		return nil, fmt.Errorf("max size must be positive")
+	case opts.Policy != evictLRU && opts.Policy != evictLFU:
+		return nil, fmt.Errorf("unknown eviction policy %q", opts.Policy)
+	case !(0 < opts.LowWatermark && opts.LowWatermark < opts.HighWatermark && opts.HighWatermark <= 1):
+		return nil, fmt.Errorf("watermarks must satisfy 0 < low (%v) < high (%v) <= 1", opts.LowWatermark, opts.HighWatermark)
+	}
+	if opts.MaxObjectSize <= 0 || opts.MaxObjectSize > opts.MaxSize {
+		opts.MaxObjectSize = opts.MaxSize
+	}
+	e := &evictor{
+		ac:       ac,
+		opts:     opts,
+		removed:  removed,
+		outputs:  map[string]*trackedOutput{},
+		actions:  map[string]string{},
+		storing:  map[string]int{},
+		removing: map[string]bool{},
+	}
+	e.removingDone = sync.NewCond(&e.mu)
+	return e, nil
+}
+
+// load tracks all entries already in the cache and evicts if needed.
+func (e *evictor) load(ctx context.Context) error {
+	err := e.ac.List(ctx, "", func(en cachers.Entry) bool {
+		size := en.Size
+		if e.extraSize != nil {
+			size += e.extraSize(en.OutputID)
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		o := e.addLocked(en.ActionID, en.OutputID, size)
+		if en.Accessed.After(o.accessed) {
+			o.accessed, o.touched = en.Accessed, en.Accessed
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if e.opts.Verbose {
+		log.Printf("[evict]\ttracking %d outputs of %d bytes; limit %d", len(e.outputs), e.total, e.opts.MaxSize)
+	}
+	e.maybeEvict()
+	return nil
+}
+
+// errTooLarge is returned for outputs larger than the maximum object size.
+var errTooLarge = errors.New("exceeds the maximum object size")
+
+// admit returns an error wrapping errTooLarge if an output of size bytes
+// may not be stored. Otherwise it waits for a running eviction of actionID
+// or outputID to finish, and keeps evictions away from both until done is
+// called, which must be after the put was stored and added.
+func (e *evictor) admit(actionID, outputID string, size int64) (done func(), err error) {
+	if e == nil {
+		return func() {}, nil
+	}
+	if size > e.opts.MaxObjectSize {
+		return nil, fmt.Errorf("output of %d bytes %w of %d bytes", size, errTooLarge, e.opts.MaxObjectSize)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for e.removing[actionID] || e.removing[outputID] {
+		e.removingDone.Wait()
+	}
+	e.storing[actionID]++
+	e.storing[outputID]++
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for _, id := range []string{actionID, outputID} {
+			if e.storing[id]--; e.storing[id] == 0 {
+				delete(e.storing, id)
+			}
+		}
+	}, nil
+}
+
+// added tracks a stored output.
+func (e *evictor) added(actionID, outputID string, size int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	o := e.addLocked(actionID, outputID, size)
+	o.accessed, o.touched = time.Now(), time.Now()
+	e.mu.Unlock()
+	e.maybeEvict()
+}
+
+// grew adds n bytes kept alongside outputID, like a compressed copy, to
+// its size.
+func (e *evictor) grew(outputID string, n int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	if o := e.outputs[outputID]; o != nil {
+		o.size += n
+		e.total += n
+	}
+	e.mu.Unlock()
+	e.maybeEvict()
+}
+
+func (e *evictor) addLocked(actionID, outputID string, size int64) *trackedOutput {
+	if old, ok := e.actions[actionID]; ok && old != outputID {
+		e.unlinkLocked(actionID)
+	}
+	o := e.outputs[outputID]
+	if o == nil {
+		o = &trackedOutput{id: outputID, size: size, actions: map[string]bool{}}
+		e.outputs[outputID] = o
+		e.total += size
+	}
+	o.actions[actionID] = true
+	e.actions[actionID] = outputID
+	return o
+}
+
+// unlinkLocked stops tracking actionID, and its output if no other action
+// resolves to it. It returns whether it stopped tracking the output.
+func (e *evictor) unlinkLocked(actionID string) (orphaned bool) {
+	outputID, ok := e.actions[actionID]
+	if !ok {
+		return false
+	}
+	delete(e.actions, actionID)
+	o := e.outputs[outputID]
+	delete(o.actions, actionID)
+	if len(o.actions) == 0 {
+		delete(e.outputs, outputID)
+		e.total -= o.size
+		return true
+	}
+	return false
+}
+
+// purged stops tracking everything, after the cache was purged.
+func (e *evictor) purged() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.outputs = map[string]*trackedOutput{}
+	e.actions = map[string]string{}
+	e.total = 0
+}
+
+// forget stops tracking an action removed from the cache, leaving its
+// output to any other actions resolving to it. It returns the output's ID
+// if no action it tracks resolves to it anymore, or "" if some do or the
+// action wasn't tracked.
+func (e *evictor) forget(actionID string) (orphaned string) {
+	if e == nil {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	outputID := e.actions[actionID]
+	if e.unlinkLocked(actionID) {
+		return outputID
+	}
+	return ""
+}
+
+// accessedAction records an access of actionID.
+func (e *evictor) accessedAction(ctx context.Context, actionID string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	o := e.outputs[e.actions[actionID]]
+	e.mu.Unlock()
+	e.accessed(ctx, o, actionID)
+}
+
+// accessedOutput records an access of outputID.
+func (e *evictor) accessedOutput(ctx context.Context, outputID string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	o := e.outputs[outputID]
+	e.mu.Unlock()
+	e.accessed(ctx, o, "")
+}
+
+func (e *evictor) accessed(ctx context.Context, o *trackedOutput, actionID string) {
+	if o == nil {
+		return
+	}
+	now := time.Now()
+	e.mu.Lock()
+	o.accessed = now
+	o.hits++
+	touch := now.Sub(o.touched) >= touchInterval
+	if touch {
+		o.touched = now
+		if actionID == "" {
+			for id := range o.actions {
+				actionID = id
+				break
+			}
+		}
+	}
+	e.mu.Unlock()
+	if touch && actionID != "" {
+		if err := e.ac.Touch(ctx, actionID, now); err != nil && e.opts.Verbose {
+			log.Printf("[evict]\trecording access of action %s: %v", actionID, err)
+		}
+	}
+}
+
+// maybeEvict starts an eviction in the background if the cache is above
+// the high watermark.
+func (e *evictor) maybeEvict() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running || e.closed || float64(e.total) <= e.opts.HighWatermark*float64(e.opts.MaxSize) {
+		return
+	}
+	e.running = true
+	e.evicting.Add(1)
+	go e.evict()
+}
+
+// close stops the running eviction, if any, and keeps new ones from
+// starting.
+func (e *evictor) close() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.evicting.Wait()
+}
+
+func (e *evictor) isClosed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+// evict removes outputs in policy order until the cache is below the low
+// watermark.
+func (e *evictor) evict() {
+	defer e.evicting.Done()
+	e.mu.Lock()
+	target := int64(e.opts.LowWatermark * float64(e.opts.MaxSize))
+	victims := make([]*trackedOutput, 0, len(e.outputs))
+	for _, o := range e.outputs {
+		victims = append(victims, o)
+	}
+	sort.Slice(victims, func(i, j int) bool {
+		a, b := victims[i], victims[j]
+		if e.opts.Policy == evictLFU && a.hits != b.hits {
+			return a.hits < b.hits
+		}
+		return a.accessed.Before(b.accessed)
+	})
+	evicted := map[string][]string{} // outputID => actionIDs
+	total := e.total
+	var bytes int64
+	for _, o := range victims {
+		if total <= target {
+			break
+		}
+		if e.isStoringLocked(o) {
+			continue
+		}
+		e.removing[o.id] = true
+		for id := range o.actions {
+			evicted[o.id] = append(evicted[o.id], id)
+			e.removing[id] = true
+			e.unlinkLocked(id)
+		}
+		total -= o.size
+		bytes += o.size
+	}
+	e.mu.Unlock()
+
+	ctx := context.Background()
+	var n int64
+	for outputID, actionIDs := range evicted {
+		if e.isClosed() {
+			break
+		}
+		for _, id := range actionIDs {
+			ok, err := e.ac.Delete(ctx, id)
+			if err != nil {
+				log.Printf("[evict]\tevicting action %s: %v", id, err)
+				continue
+			}
+			if ok {
+				n++
+			}
+		}
+		if _, err := e.ac.DeleteOutput(ctx, outputID); err != nil {
+			log.Printf("[evict]\tevicting output %s: %v", outputID, err)
+		}
+		if e.outputEvicted != nil {
+			e.outputEvicted(outputID)
+		}
+		e.mu.Lock()
+		delete(e.removing, outputID)
+		for _, id := range actionIDs {
+			delete(e.removing, id)
+		}
+		e.removingDone.Broadcast()
+		e.mu.Unlock()
+	}
+	e.removed(n)
+	if e.opts.Verbose {
+		log.Printf("[evict]\tevicted %d actions, %d bytes", n, bytes)
+	}
+	e.mu.Lock()
+	e.running = false
+	// Outputs left when closed may be put again.
+	clear(e.removing)
+	e.removingDone.Broadcast()
+	e.mu.Unlock()
+	// Puts may have raced with this eviction.
+	e.maybeEvict()
+}
+
+// isStoringLocked reports whether a put of o or one of its actions is in
+// progress.
+func (e *evictor) isStoringLocked(o *trackedOutput) bool {
+	if e.storing[o.id] > 0 {
+		return true
+	}
+	for id := range o.actions {
+		if e.storing[id] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a byte count like "500M" or "10GiB" with binary units.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := int64(1)
+	if i := len(num) - 1; i >= 0 {
+		if n := strings.IndexByte("KMGT", num[i]); n >= 0 {
+			mult = 1 << (10 * (n + 1))
+			num = num[:i]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// newStoreEvictor returns the evictor for srv's store limited to maxSize
+// and maxObject, with the rest configured by flags, and starts tracking
+// the store's entries.
+func newStoreEvictor(ctx context.Context, srv *server, maxSize, maxObject string) (*evictor, error) {
+	ac := srv.store.Admin()
+	if ac == nil {
+		return nil, fmt.Errorf("-max-size needs a disk backend")
+	}
+	opts := evictorOptions{
+		HighWatermark: *highWater,
+		LowWatermark:  *lowWater,
+		Policy:        *policy,
+		Verbose:       srv.verbose,
+	}
+	var err error
+	if opts.MaxSize, err = parseSize(maxSize); err != nil {
+		return nil, err
+	}
+	if maxObject != "" {
+		if opts.MaxObjectSize, err = parseSize(maxObject); err != nil {
+			return nil, err
+		}
+	}
+	e, err := newEvictor(ac, opts, func(n int64) { srv.metrics.removed.Add(n) })
+	if err != nil {
+		return nil, err
+	}
+	if srv.storeCompressed {
+		e.extraSize = srv.compressedSize
+		e.outputEvicted = srv.removeCompressedCopies
+	}
+	if ps, ok := srv.store.(*proxyStorage); ok {
+		ps.filled = e.added
+	}
+	return e, e.load(ctx)
+}
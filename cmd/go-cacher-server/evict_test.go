@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestEviction(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		want   []string // actions left
+	}{
+		{evictLRU, []string{"a000", "a003"}},
+		{evictLFU, []string{"a000", "a001"}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			srv := newTestServer(t)
+			e, err := newEvictor(srv.store.Admin(), evictorOptions{
+				MaxSize:       1000,
+				HighWatermark: 0.9,
+				LowWatermark:  0.5,
+				MaxObjectSize: 400,
+				Policy:        tt.policy,
+			}, func(n int64) { srv.metrics.removed.Add(n) })
+			require.NoError(t, err)
+			srv.evict = e
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+			ctx := context.Background()
+			put := func(actionID, outputID string, size int) error {
+				return c.Put(ctx, actionID, outputID, int64(size), strings.NewReader(strings.Repeat("x", size)))
+			}
+
+			err = put("a009", "b009", 500)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "413")
+
+			for _, id := range []string{"000", "001", "002"} {
+				require.NoError(t, put("a"+id, "b"+id, 250))
+			}
+			// a000 is the most recently used; a001 the most frequently.
+			for _, id := range []string{"a001", "a001", "a000"} {
+				_, _, err := getString(t, c, id)
+				require.NoError(t, err)
+			}
+			require.NoError(t, put("a003", "b003", 250))
+
+			assert.Eventually(t, func() bool {
+				var left []string
+				_ = srv.store.Admin().List(ctx, "", func(en cachers.Entry) bool {
+					left = append(left, en.ActionID)
+					return true
+				})
+				outputs, _ := filepath.Glob(filepath.Join(srv.dir, "o-*"))
+				return assert.ObjectsAreEqual(tt.want, left) && len(outputs) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, int64(2), srv.metrics.removed.Load())
+
+			// A restarted evictor picks up what's there.
+			e2, err := newEvictor(srv.store.Admin(), e.opts, func(int64) {})
+			require.NoError(t, err)
+			require.NoError(t, e2.load(ctx))
+			assert.Equal(t, int64(500), e2.total)
+		})
+	}
+}
+
+func TestEvictionCompressedCopies(t *testing.T) {
+	srv := newTestServer(t)
+	srv.compressions = []*cachers.Compression{cachers.LookupCompression("gzip")}
+	srv.storeCompressed = true
+	e, err := newEvictor(srv.store.Admin(), evictorOptions{
+		MaxSize:       10000,
+		HighWatermark: 0.9,
+		LowWatermark:  0.5,
+		Policy:        evictLRU,
+	}, func(int64) {})
+	require.NoError(t, err)
+	e.extraSize, e.outputEvicted = srv.compressedSize, srv.removeCompressedCopies
+	srv.evict = e
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	ctx := context.Background()
+	// The outputs alone fill the cache up to the high watermark; their
+	// compressed copies take it over.
+	for _, id := range []string{"000", "001", "002"} {
+		require.NoError(t, c.Put(ctx, "a"+id, "b"+id, 3000, strings.NewReader(strings.Repeat("x", 3000))))
+		srv.compressing.Wait()
+	}
+	zb000 := compressedFilename(srv.dir, "b000", srv.compressions[0])
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(zb000)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, compressedFilename(srv.dir, "b002", srv.compressions[0]))
+
+	e2, err := newEvictor(srv.store.Admin(), e.opts, func(int64) {})
+	require.NoError(t, err)
+	e2.extraSize = srv.compressedSize
+	require.NoError(t, e2.load(ctx))
+	assert.Greater(t, e2.total, int64(3000))
+}
+
+// blockingAdmin holds up the deletion of one action until release is
+// closed.
+type blockingAdmin struct {
+	cachers.AdminCache
+	block    string
+	deleting chan struct{} // closed once block is being deleted
+	release  chan struct{}
+}
+
+func (ba *blockingAdmin) Delete(ctx context.Context, actionID string) (bool, error) {
+	if actionID == ba.block {
+		close(ba.deleting)
+		<-ba.release
+	}
+	return ba.AdminCache.Delete(ctx, actionID)
+}
+
+func TestEvictionRacingPut(t *testing.T) {
+	srv := newTestServer(t)
+	ba := &blockingAdmin{
+		AdminCache: srv.store.Admin(),
+		block:      "a000",
+		deleting:   make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	e, err := newEvictor(ba, evictorOptions{
+		MaxSize:       1000,
+		HighWatermark: 0.9,
+		LowWatermark:  0.5,
+		Policy:        evictLRU,
+	}, func(int64) {})
+	require.NoError(t, err)
+	srv.evict = e
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	ctx := context.Background()
+	put := func(actionID, outputID string) error {
+		return c.Put(ctx, actionID, outputID, 250, strings.NewReader(strings.Repeat("x", 250)))
+	}
+	for _, id := range []string{"000", "001", "002", "003"} {
+		require.NoError(t, put("a"+id, "b"+id))
+	}
+
+	// a000 is put again while its eviction is underway. The put must wait
+	// for the eviction rather than be removed by it.
+	<-ba.deleting
+	putDone := make(chan error, 1)
+	go func() { putDone <- put("a000", "b000") }()
+	select {
+	case err := <-putDone:
+		t.Fatalf("put during the eviction of its action finished first: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(ba.release)
+	require.NoError(t, <-putDone)
+	assert.Eventually(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return !e.running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	outputID, body, err := getString(t, c, "a000")
+	require.NoError(t, err)
+	assert.Equal(t, "b000", outputID)
+	assert.Equal(t, strings.Repeat("x", 250), body)
+	e.mu.Lock()
+	assert.Equal(t, "b000", e.actions["a000"])
+	e.mu.Unlock()
+}
+
+func TestEvictionRepair(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	for _, id := range []string{"001", "002"} {
+		_, err := srv.store.Put(ctx, "a"+id, "b"+id, 5, strings.NewReader("hello"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.Remove(filepath.Join(srv.dir, "o-b002")))
+	e, err := newEvictor(srv.store.Admin(), evictorOptions{MaxSize: 1000, MaxObjectSize: 1000, HighWatermark: 0.9, LowWatermark: 0.5, Policy: evictLRU}, func(int64) {})
+	require.NoError(t, err)
+	require.NoError(t, e.load(ctx))
+	assert.EqualValues(t, 10, e.total)
+	srv.evict = e
+
+	// The repair removes the dangling entry loaded above, which must stop
+	// counting toward the size limit.
+	srv.repair(ctx)
+	assert.NoFileExists(t, filepath.Join(srv.dir, "a-a002"))
+	assert.EqualValues(t, 5, e.total)
+	assert.EqualValues(t, 1, srv.metrics.removed.Load())
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"123":    123,
+		"2K":     2 << 10,
+		"1.5MiB": 3 << 19,
+		"10GB":   10 << 30,
+		"1t":     1 << 40,
+	} {
+		got, err := parseSize(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, err := parseSize("lots")
+	assert.Error(t, err)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLimitedClients is how many clients a limiter tracks before it forgets
+// idle ones.
+const maxLimitedClients = 10000
+
+// limiterOptions configures newLimiter. Zero fields don't limit.
+type limiterOptions struct {
+	Rate              float64 // requests per second per client
+	Burst             int     // requests a client may make at once; defaults to Rate
+	Bandwidth         int64   // body bytes per second per client, in and out
+	MaxInflight       int     // requests served at once
+	MaxClientInflight int     // requests served at once per client
+}
+
+// limiter protects the server from clients hogging it. Requests over a
+// client's rate or the in-flight caps get 429 Too Many Requests with a
+// Retry-After header; bodies of clients over their bandwidth are slowed
+// down. One limiter is shared by all namespaces. Its methods are no-ops on
+// a nil *limiter.
+type limiter struct {
+	opts limiterOptions
+
+	mu       sync.Mutex
+	inflight int                     // guarded by mu
+	clients  map[string]*clientLimit // guarded by mu
+}
+
+// clientLimit is the state of one client.
+type clientLimit struct {
+	requests bucket
+	bytes    bucket
+	inflight int
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens from a bucket refilled at rate per second up to burst,
+// going into debt if needed. It returns how long until the bucket is out of
+// debt again.
+func (b *bucket) take(n, rate, burst float64, now time.Time) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled by now, so forgetting it
+// loses nothing.
+func (b *bucket) full(rate, burst float64, now time.Time) bool {
+	return b.last.IsZero() || b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+func newLimiter(opts limiterOptions) *limiter {
+	if opts == (limiterOptions{}) {
+		return nil
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = max(1, int(math.Ceil(opts.Rate)))
+	}
+	return &limiter{opts: opts, clients: map[string]*clientLimit{}}
+}
+
+// admit decides whether the request of client may be served, and if not
+// answers it with 429. If it returns true, the caller must call done once
+// the request is finished.
+func (l *limiter) admit(w http.ResponseWriter, client string) (done func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cl := l.client(client)
+	var wait time.Duration
+	switch {
+	case l.opts.MaxInflight > 0 && l.inflight >= l.opts.MaxInflight,
+		l.opts.MaxClientInflight > 0 && cl.inflight >= l.opts.MaxClientInflight:
+		wait = time.Second
+	case l.opts.Rate > 0:
+		if wait = cl.requests.take(1, l.opts.Rate, float64(l.opts.Burst), time.Now()); wait > 0 {
+			// Don't count the rejected request against the client.
+			cl.requests.tokens++
+		}
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return nil, false
+	}
+	l.inflight++
+	cl.inflight++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inflight--
+		cl.inflight--
+	}, true
+}
+
+// client returns the state of client, forgetting idle clients when there
+// are too many. l.mu must be held.
+func (l *limiter) client(client string) *clientLimit {
+	cl := l.clients[client]
+	if cl != nil {
+		return cl
+	}
+	if len(l.clients) >= maxLimitedClients {
+		now := time.Now()
+		for name, c := range l.clients {
+			if c.inflight == 0 &&
+				c.requests.full(l.opts.Rate, float64(l.opts.Burst), now) &&
+				c.bytes.full(float64(l.opts.Bandwidth), float64(l.opts.Bandwidth), now) {
+				delete(l.clients, name)
+			}
+		}
+	}
+	cl = &clientLimit{}
+	l.clients[client] = cl
+	return cl
+}
+
+// throttle waits until client may transfer n more body bytes.
+func (l *limiter) throttle(ctx context.Context, client string, n int) error {
+	if l == nil || l.opts.Bandwidth <= 0 || n == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	// One second's worth of burst.
+	wait := l.client(client).bytes.take(float64(n), float64(l.opts.Bandwidth), float64(l.opts.Bandwidth), time.Now())
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// throttledReader is a request body limited to its client's bandwidth.
+type throttledReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	l      *limiter
+	client string
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	if terr := tr.l.throttle(tr.ctx, tr.client, n); terr != nil && err == nil {
+		err = terr
+	}
+	return n, err
+}
+
+// throttledWriter is a response writer limited to its client's bandwidth.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	l      *limiter
+	client string
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	if err := tw.l.throttle(tw.ctx, tw.client, len(p)); err != nil {
+		return 0, err
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// limitRequest applies s.limits to r. It returns false if r was refused;
+// otherwise the caller must call done when r is finished.
+func (s *server) limitRequest(w http.ResponseWriter, r *http.Request) (_ http.ResponseWriter, _ *http.Request, done func(), ok bool) {
+	if s.limits == nil || r.URL.Path == "/" || r.URL.Path == "/metrics" {
+		// Leave health checks and monitoring alone.
+		return w, r, func() {}, true
+	}
+	client := s.clientName(r)
+	done, ok = s.limits.admit(w, client)
+	if !ok {
+		return w, r, nil, false
+	}
+	if s.limits.opts.Bandwidth > 0 {
+		r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), l: s.limits, client: client}
+		w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), l: s.limits, client: client}
+	}
+	return w, r, done, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	srv := newTestServer(t)
+	srv.limits = newLimiter(limiterOptions{Rate: 1, Burst: 2})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		return res
+	}
+	assert.Equal(t, http.StatusNotFound, get("/action/aaaa").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get("/action/aaaa").StatusCode)
+	res := get("/action/aaaa")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("Retry-After"))
+	// Health checks and metrics aren't limited.
+	assert.Equal(t, http.StatusOK, get("/").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/metrics").StatusCode)
+	assert.Equal(t, int64(1), srv.metrics.requests[requestKey{"action", http.StatusTooManyRequests}])
+}
+
+func TestInflightLimit(t *testing.T) {
+	l := newLimiter(limiterOptions{MaxInflight: 2, MaxClientInflight: 1})
+	w := httptest.NewRecorder()
+	done1, ok := l.admit(w, "a")
+	require.True(t, ok)
+	_, ok = l.admit(w, "a")
+	assert.False(t, ok, "over the per client cap")
+	done2, ok := l.admit(httptest.NewRecorder(), "b")
+	require.True(t, ok)
+	w = httptest.NewRecorder()
+	_, ok = l.admit(w, "c")
+	assert.False(t, ok, "over the global cap")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	done1()
+	done2()
+	_, ok = l.admit(httptest.NewRecorder(), "c")
+	assert.True(t, ok)
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	srv := newTestServer(t)
+	srv.limits = newLimiter(limiterOptions{Bandwidth: 64 << 10})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	body := bytes.Repeat([]byte("x"), 96<<10)
+	req, err := http.NewRequest("PUT", ts.URL+"/aaaa/bbbb", bytes.NewReader(body))
+	require.NoError(t, err)
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	// The first 64KiB are the burst, the other 32KiB take half a second.
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// listenOn listens on addr, a TCP address like ":31364" or a Unix socket
+// path like "unix:/run/go-cacher.sock" or "unix:///run/go-cacher.sock".
+// A Unix socket gets permissions mode before anyone can connect to it, and
+// a stale socket left by a previous run is replaced. Its clients are named
+// after their user, see peerName.
+func listenOn(addr string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := cachers.UnixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	// The socket is created with the umask's permissions, so it's created
+	// in a directory only we can enter and moved into place once it has
+	// its own.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir) //nolint:errcheck
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = ln.Close()
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// unixListener is a Unix socket listener moved to path, which it removes
+// on Close. Its connections' RemoteAddr carries the peer's user ID where
+// the kernel tells, like "unix:1000", or is "unix".
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr := peerAddr("unix")
+	if uid, ok := peerUID(c); ok {
+		addr = peerAddr("unix:" + uid)
+	}
+	return &peerConn{Conn: c, addr: addr}, nil
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// peerConn is a Unix socket connection whose RemoteAddr identifies its
+// peer, which names the client of its requests, see peerName.
+type peerConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// peerAddr is the name of a Unix socket peer.
+type peerAddr string
+
+func (a peerAddr) Network() string { return "unix" }
+func (a peerAddr) String() string  { return string(a) }
+
+// userNames caches peerName's names by user ID, as looking a user up may
+// take a trip to a directory service.
+var userNames sync.Map // uid => name
+
+// peerName names the Unix socket peer with the RemoteAddr addr, like
+// "unix:1000", after its user, like "unix:alice". Users that can't be
+// looked up keep their ID.
+func peerName(addr string) string {
+	uid, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return addr
+	}
+	if name, ok := userNames.Load(uid); ok {
+		return name.(string)
+	}
+	name := addr
+	if u, err := user.LookupId(uid); err == nil {
+		name = "unix:" + u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
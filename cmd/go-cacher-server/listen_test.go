@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "cacher.sock")
+
+	// A socket left behind by a crashed server is replaced.
+	stale, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	ln, err := listenOn("unix:"+sock, 0600)
+	require.NoError(t, err)
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	srv := newTestServer(t)
+	var mu sync.Mutex
+	var clients []string
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clients = append(clients, srv.clientName(r))
+		mu.Unlock()
+		srv.ServeHTTP(w, r)
+	})}
+	go func() { _ = hs.Serve(ln) }()
+
+	_, err = listenOn("unix://"+sock, 0600)
+	assert.ErrorContains(t, err, "in use")
+
+	for _, base := range []string{"unix://" + sock, "unix:" + sock} {
+		c := cachers.NewHttpCache(base, cachers.HTTPCacheOptions{}, false)
+		require.NoError(t, c.Put(context.Background(), "aaaa", "bbbb", 5, strings.NewReader("hello")))
+		outputID, body, err := getString(t, c, "aaaa")
+		require.NoError(t, err)
+		assert.Equal(t, "bbbb", outputID)
+		assert.Equal(t, "hello", body)
+	}
+
+	// Clients are named after their user where the kernel tells.
+	want := "unix"
+	if runtime.GOOS == "linux" {
+		u, err := user.Current()
+		require.NoError(t, err)
+		want = "unix:" + u.Username
+	}
+	mu.Lock()
+	assert.Equal(t, want, clients[0])
+	mu.Unlock()
+
+	require.NoError(t, hs.Close())
+	assert.NoFileExists(t, sock)
+	tmps, _ := filepath.Glob(filepath.Join(filepath.Dir(sock), ".gc*"))
+	assert.Empty(t, tmps)
+}
+
+func TestUnixSocketPeer(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "peer.sock")
+	ln, err := listenOn("unix:"+sock, 0600)
+	require.NoError(t, err)
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("peer read,write,admin\n"), 0600))
+	b := newTestServer(t)
+	b.auth, err = loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	hs := &http.Server{Handler: b}
+	go func() { _ = hs.Serve(ln) }()
+	defer hs.Close() //nolint:errcheck
+	ctx := context.Background()
+	_, err = b.store.Put(ctx, "a001", "b001", 5, strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	a := newTestServer(t)
+	a.replicas = newReplicator(a, replicatorOptions{
+		Peers: []string{"unix://" + sock},
+		Auth:  cachers.BearerTokenAuth{Token: "peer"},
+	})
+	n, err := a.replicas.sync(ctx, a.replicas.peers[0])
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = a.store.Put(ctx, "a002", "b002", 5, strings.NewReader("world"))
+	require.NoError(t, err)
+	a.replicas.start(ctx)
+	a.replicas.replicate("a002", "b002")
+	a.replicas.close(time.Minute)
+	assert.Equal(t, int64(1), a.metrics.replicated.Load())
+}
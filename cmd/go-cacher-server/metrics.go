@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// diskUsageMaxAge is how long a computed disk usage is reported before
+// the cache directory is walked again.
+const diskUsageMaxAge = 30 * time.Second
+
+// metrics are the server's Prometheus metrics, served at /metrics in the
+// text exposition format. The zero value is ready to use.
+type metrics struct {
+	hits, misses       atomic.Int64
+	bytesIn, bytesOut  atomic.Int64
+	removed            atomic.Int64 // entries evicted or deleted
+	rejected           atomic.Int64 // uploads not matching their output ID
+	replicated         atomic.Int64 // puts copied to peers
+	replicationErrors  atomic.Int64 // puts that failed to reach a peer
+	synced             atomic.Int64 // entries copied from peers by anti-entropy
+	scrubbed           atomic.Int64 // output bytes hashed by scrubs
+	scrubProblems      atomic.Int64 // problems found by scrubs
+	mu                 sync.Mutex
+	requests           map[requestKey]int64  // guarded by mu
+	latency            map[string]*histogram // by endpoint; guarded by mu
+	diskMu             sync.Mutex            // held while walking the cache directory, so requests don't wait on it
+	diskBytes, diskObj int64                 // guarded by diskMu
+	diskAt             time.Time             // when diskBytes was computed; guarded by diskMu
+}
+
+type requestKey struct {
+	endpoint string
+	code     int
+}
+
+type histogram struct {
+	counts []int64 // per latencyBuckets, not cumulative
+	count  int64
+	sum    float64
+}
+
+// endpoint names the endpoint of r for metric labels.
+func endpoint(r *http.Request) string {
+	switch {
+	case r.Method == "PUT":
+		return "put"
+	case r.URL.Path == "/batch/exists":
+		return "batch_exists"
+	case r.URL.Path == "/batch/get":
+		return "batch_get"
+	case strings.HasPrefix(r.URL.Path, "/action/"):
+		return "action"
+	case strings.HasPrefix(r.URL.Path, "/output/"):
+		return "output"
+	case r.URL.Path == "/metrics":
+		return "metrics"
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return "admin"
+	case r.URL.Path == "/dashboard", r.URL.Path == "/dashboard/data":
+		return "dashboard"
+	case r.URL.Path == "/":
+		return "root"
+	}
+	return "other"
+}
+
+// observe records a finished request.
+func (m *metrics) observe(endpoint string, code int, d time.Duration, in, out int64) {
+	m.bytesIn.Add(in)
+	m.bytesOut.Add(out)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestKey]int64{}
+		m.latency = map[string]*histogram{}
+	}
+	m.requests[requestKey{endpoint, code}]++
+	h := m.latency[endpoint]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[endpoint] = h
+	}
+	secs := d.Seconds()
+	h.count++
+	h.sum += secs
+	if i := sort.SearchFloat64s(latencyBuckets, secs); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+}
+
+// lookup records a cache hit or miss of an action lookup. Outputs are
+// fetched after a hit on their action, so they don't count again.
+func (m *metrics) lookup(hit bool) {
+	if hit {
+		m.hits.Add(1)
+	} else {
+		m.misses.Add(1)
+	}
+}
+
+// diskUsage returns the bytes and files in dir, walking it at most every
+// diskUsageMaxAge.
+func (m *metrics) diskUsage(dir string) (size, objects int64) {
+	m.diskMu.Lock()
+	defer m.diskMu.Unlock()
+	if time.Since(m.diskAt) < diskUsageMaxAge {
+		return m.diskBytes, m.diskObj
+	}
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir {
+				// Other namespaces' directories.
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			size += fi.Size()
+			objects++
+		}
+		return nil
+	})
+	m.diskBytes, m.diskObj, m.diskAt = size, objects, time.Now()
+	return size, objects
+}
+
+// metricsSet is the metrics of one namespace, for writeMetrics.
+type metricsSet struct {
+	namespace string // empty for the default namespace
+	m         *metrics
+	dir       string // cache directory to report the size of, if any
+}
+
+// labels formats the label pairs kv for a sample of set, or returns the
+// empty string if there are none.
+func (set metricsSet) labels(kv ...string) string {
+	if set.namespace != "" {
+		kv = append([]string{"namespace", set.namespace}, kv...)
+	}
+	if len(kv) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", kv[i], kv[i+1])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// writeMetrics writes the metrics of sets in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer, sets []metricsSet) {
+	family := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	counter := func(name, help string, v func(*metrics) int64) {
+		family(name, "counter", help)
+		for _, set := range sets {
+			fmt.Fprintf(w, "%s%s %d\n", name, set.labels(), v(set.m))
+		}
+	}
+	counter("gocacher_cache_hits_total", "Action lookups that were found.", func(m *metrics) int64 { return m.hits.Load() })
+	counter("gocacher_cache_misses_total", "Action lookups that were not found.", func(m *metrics) int64 { return m.misses.Load() })
+	counter("gocacher_cache_removed_total", "Entries evicted or deleted.", func(m *metrics) int64 { return m.removed.Load() })
+	counter("gocacher_uploads_rejected_total", "Uploads rejected for not matching their output ID.", func(m *metrics) int64 { return m.rejected.Load() })
+	counter("gocacher_replication_puts_total", "Puts copied to peers.", func(m *metrics) int64 { return m.replicated.Load() })
+	counter("gocacher_replication_errors_total", "Puts that failed to reach a peer or were dropped.", func(m *metrics) int64 { return m.replicationErrors.Load() })
+	counter("gocacher_replication_synced_total", "Entries copied from peers by anti-entropy.", func(m *metrics) int64 { return m.synced.Load() })
+	counter("gocacher_scrub_bytes_total", "Output bytes hashed by scrubs.", func(m *metrics) int64 { return m.scrubbed.Load() })
+	counter("gocacher_scrub_problems_total", "Corrupt outputs and index entries, dangling index entries and orphaned outputs found by scrubs.", func(m *metrics) int64 { return m.scrubProblems.Load() })
+	counter("gocacher_http_request_bytes_total", "Bytes of request bodies read.", func(m *metrics) int64 { return m.bytesIn.Load() })
+	counter("gocacher_http_response_bytes_total", "Bytes of response bodies written.", func(m *metrics) int64 { return m.bytesOut.Load() })
+
+	type usage struct{ size, files int64 }
+	usages := make([]usage, len(sets))
+	haveDisk := false
+	for i, set := range sets {
+		if set.dir != "" {
+			usages[i].size, usages[i].files = set.m.diskUsage(set.dir)
+			haveDisk = true
+		}
+	}
+	if haveDisk {
+		family("gocacher_cache_size_bytes", "gauge", "Bytes of files in the cache directory.")
+		for i, set := range sets {
+			if set.dir != "" {
+				fmt.Fprintf(w, "gocacher_cache_size_bytes%s %d\n", set.labels(), usages[i].size)
+			}
+		}
+		family("gocacher_cache_files", "gauge", "Files in the cache directory.")
+		for i, set := range sets {
+			if set.dir != "" {
+				fmt.Fprintf(w, "gocacher_cache_files%s %d\n", set.labels(), usages[i].files)
+			}
+		}
+	}
+
+	family("gocacher_http_requests_total", "counter", "HTTP requests by endpoint and status code.")
+	for _, set := range sets {
+		set.m.writeRequests(w, set)
+	}
+	family("gocacher_http_request_duration_seconds", "histogram", "HTTP request latency by endpoint.")
+	for _, set := range sets {
+		set.m.writeLatency(w, set)
+	}
+}
+
+func (m *metrics) writeRequests(w io.Writer, set metricsSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "gocacher_http_requests_total%s %d\n", set.labels("endpoint", k.endpoint, "code", strconv.Itoa(k.code)), m.requests[k])
+	}
+}
+
+func (m *metrics) writeLatency(w io.Writer, set metricsSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endpoints := make([]string, 0, len(m.latency))
+	for ep := range m.latency {
+		endpoints = append(endpoints, ep)
+	}
+	sort.Strings(endpoints)
+	for _, ep := range endpoints {
+		h := m.latency[ep]
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "gocacher_http_request_duration_seconds_bucket%s %d\n", set.labels("endpoint", ep, "le", strconv.FormatFloat(le, 'g', -1, 64)), cum)
+		}
+		fmt.Fprintf(w, "gocacher_http_request_duration_seconds_bucket%s %d\n", set.labels("endpoint", ep, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "gocacher_http_request_duration_seconds_sum%s %s\n", set.labels("endpoint", ep), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "gocacher_http_request_duration_seconds_count%s %d\n", set.labels("endpoint", ep), h.count)
+	}
+}
+
+func (s *server) metricsSet() metricsSet {
+	return metricsSet{namespace: s.namespace, m: &s.metrics, dir: s.dir}
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, []metricsSet{s.metricsSet()})
+}
+
+// metricsWriter records the status and body size of a response.
+type metricsWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (mw *metricsWriter) WriteHeader(code int) {
+	if mw.code == 0 {
+		mw.code = code
+	}
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+func (mw *metricsWriter) Write(b []byte) (int, error) {
+	if mw.code == 0 {
+		mw.code = http.StatusOK
+	}
+	n, err := mw.ResponseWriter.Write(b)
+	mw.written += int64(n)
+	return n, err
+}
+
+func (mw *metricsWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+// metricsReader counts the bytes read of a request body.
+type metricsReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (mr *metricsReader) Read(b []byte) (int, error) {
+	n, err := mr.ReadCloser.Read(b)
+	mr.read += int64(n)
+	return n, err
+}
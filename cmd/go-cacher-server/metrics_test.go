@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	ctx := context.Background()
+
+	require.NoError(t, c.Put(ctx, testActionID, testOutputID, 5, strings.NewReader("hello")))
+	_, _, err := getString(t, c, testActionID)
+	require.NoError(t, err)
+	outputID, _, err := getString(t, c, "cccc")
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+	// Fetching the output of an action looked up is part of the same hit.
+	res, err := http.Get(ts.URL + "/output/" + testOutputID)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close() //nolint:errcheck
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	got := string(b)
+	for _, want := range []string{
+		"gocacher_cache_hits_total 1\n",
+		"gocacher_cache_misses_total 1\n",
+		"gocacher_http_request_bytes_total 5\n",
+		`gocacher_http_requests_total{endpoint="put",code="204"} 1` + "\n",
+		`gocacher_http_requests_total{endpoint="action",code="200"} 1` + "\n",
+		`gocacher_http_requests_total{endpoint="action",code="404"} 1` + "\n",
+		`gocacher_http_request_duration_seconds_count{endpoint="action"} 2` + "\n",
+		`gocacher_http_request_duration_seconds_bucket{endpoint="put",le="+Inf"} 1` + "\n",
+		"gocacher_cache_files 2\n",
+	} {
+		assert.Contains(t, got, want)
+	}
+}
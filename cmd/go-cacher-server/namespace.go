@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Namespaces let one server serve several teams or repositories from
+// separate storage, with separate quotas and stats. Requests select a
+// namespace with a /ns/<namespace> URL prefix or with a token bound to it;
+// others go to the default namespace, which is the server's storage root.
+
+// validNamespace reports whether name is a valid namespace name.
+func validNamespace(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i := range name {
+		b := name[i]
+		if b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-' || b == '_' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// namespaceConfig is a namespace listed in the -namespaces file.
+type namespaceConfig struct {
+	name          string
+	maxSize       string // overrides -max-size
+	maxObjectSize string // overrides -max-object-size
+}
+
+// loadNamespaces reads a namespaces file. It has one namespace per line:
+//
+//	<namespace> [max-size=<size>] [max-object-size=<size>]
+//
+// Blank lines and lines starting with '#' are ignored.
+func loadNamespaces(path string) ([]namespaceConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+	var nss []namespaceConfig
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		nc := namespaceConfig{name: fields[0]}
+		if !validNamespace(nc.name) {
+			return nil, fmt.Errorf("%s:%d: bad namespace %q; use a-z, 0-9, '-' and '_'", path, lineNum, nc.name)
+		}
+		if seen[nc.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate namespace %q", path, lineNum, nc.name)
+		}
+		seen[nc.name] = true
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			switch k {
+			case "max-size":
+				nc.maxSize = v
+			case "max-object-size":
+				nc.maxObjectSize = v
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown setting %q", path, lineNum, f)
+			}
+			if _, err := parseSize(v); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			}
+		}
+		nss = append(nss, nc)
+	}
+	return nss, sc.Err()
+}
+
+// authorize checks that r carries a token with the need scope that may
+// use s's namespace. Otherwise it writes an error response and returns false.
+func (s *server) authorize(w http.ResponseWriter, r *http.Request, need scope) bool {
+	ti := s.auth.authorize(w, r, need)
+	if ti == nil {
+		return false
+	}
+	if ti.namespace != "" && ti.namespace != s.namespace {
+		http.Error(w, "token is confined to namespace "+ti.namespace, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// router sends requests to the server of their namespace.
+type router struct {
+	def        *server
+	namespaces map[string]*server
+	auth       *tokenAuth // or nil
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/ns/"); ok {
+		name, path, _ := strings.Cut(rest, "/")
+		ns := rt.namespaces[name]
+		if ns == nil {
+			http.Error(w, "unknown namespace", http.StatusNotFound)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + path
+		r2.RequestURI = strings.TrimPrefix(r.RequestURI, "/ns/"+name)
+		ns.ServeHTTP(w, r2)
+		return
+	}
+	if r.URL.Path == "/metrics" {
+		rt.handleMetrics(w, r)
+		return
+	}
+	if rt.auth != nil {
+		if ti := rt.auth.lookup(r); ti != nil && ti.namespace != "" {
+			if ns := rt.namespaces[ti.namespace]; ns != nil {
+				ns.ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+	rt.def.ServeHTTP(w, r)
+}
+
+// handleMetrics serves the metrics of all namespaces, labeled with theirs.
+func (rt *router) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	sets := []metricsSet{rt.def.metricsSet()}
+	names := make([]string, 0, len(rt.namespaces))
+	for name := range rt.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sets = append(sets, rt.namespaces[name].metricsSet())
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, sets)
+}
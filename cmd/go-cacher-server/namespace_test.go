@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestNamespaces(t *testing.T) {
+	d := t.TempDir()
+	tokenFile := filepath.Join(d, "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("all read,write\nteama read,write ci-a ns=team-a\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+
+	newNS := func(name string) *server {
+		dir := namespaceDir(filepath.Join(d, "cache"), name)
+		return &server{namespace: name, store: newLocalStorage(newDiskCache(storageOptions{Dir: dir})), dir: dir, auth: ta}
+	}
+	rt := &router{def: newNS(""), namespaces: map[string]*server{}, auth: ta}
+	for _, name := range []string{"team-a", "team-b"} {
+		rt.namespaces[name] = newNS(name)
+		require.NoError(t, rt.namespaces[name].store.Start(context.Background()))
+	}
+	require.NoError(t, rt.def.store.Start(context.Background()))
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+
+	client := func(token, ns string) *cachers.HTTPCache {
+		return cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: token}, Namespace: ns}, false)
+	}
+	ctx := context.Background()
+	require.NoError(t, client("all", "team-a").Put(ctx, testActionID, testOutputID, 5, strings.NewReader("hello")))
+	_, err = os.Stat(filepath.Join(d, "cache", "ns", "team-a", "o-"+testOutputID))
+	assert.NoError(t, err)
+
+	for _, tt := range []struct {
+		token, ns string
+		want      string // output ID found, if any
+		wantErr   bool
+	}{
+		{token: "all", ns: "team-a", want: testOutputID},
+		{token: "all", ns: "team-b"},
+		{token: "all"},
+		{token: "teama", want: testOutputID}, // the token selects team-a
+		{token: "teama", ns: "team-a", want: testOutputID},
+		{token: "teama", ns: "team-b", wantErr: true},
+	} {
+		outputID, _, err := getString(t, client(tt.token, tt.ns), testActionID)
+		if tt.wantErr {
+			assert.ErrorIs(t, err, cachers.ErrForbidden, "%+v", tt)
+			continue
+		}
+		require.NoError(t, err, "%+v", tt)
+		assert.Equal(t, tt.want, outputID, "%+v", tt)
+	}
+
+	res, err := http.Get(ts.URL + "/ns/nope/action/" + testActionID)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	b, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.Contains(t, string(b), `gocacher_cache_hits_total{namespace="team-a"} 3`+"\n")
+	assert.Contains(t, string(b), "gocacher_cache_misses_total 1\n")
+	assert.Contains(t, string(b), `gocacher_cache_files{namespace="team-a"} 2`+"\n")
+	assert.Contains(t, string(b), "gocacher_cache_files 0\n")
+}
+
+func TestLoadNamespaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "namespaces")
+	require.NoError(t, os.WriteFile(path, []byte("# teams\nteam-a max-size=10G\n\nteam-b max-object-size=1M\n"), 0600))
+	nss, err := loadNamespaces(path)
+	require.NoError(t, err)
+	assert.Equal(t, []namespaceConfig{
+		{name: "team-a", maxSize: "10G"},
+		{name: "team-b", maxObjectSize: "1M"},
+	}, nss)
+
+	for _, bad := range []string{"Team\n", "a\na\n", "a quota=1\n", "a max-size=lots\n"} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0600))
+		_, err := loadNamespaces(path)
+		assert.Error(t, err, bad)
+	}
+}
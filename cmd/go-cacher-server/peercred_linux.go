@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// peerUID returns the ID of the user running the client at the other end
+// of the Unix socket c, from the credentials the kernel recorded when it
+// connected.
+func peerUID(c net.Conn) (uid string, ok bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return "", false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(cred.Uid), 10), true
+}
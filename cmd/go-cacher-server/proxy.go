@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// How proxyStorage propagates puts to its upstream.
+const (
+	writeThrough = "through" // upload before answering the PUT
+	writeBack    = "back"    // answer the PUT, upload in the background
+	writeNone    = "none"    // never upload; a read-only mirror
+)
+
+const (
+	// writeBackQueueSize is the most uploads write-back mode keeps pending.
+	// Puts arriving while the queue is full aren't uploaded.
+	writeBackQueueSize = 1024
+	writeBackWorkers   = 4
+)
+
+// proxyStorage is a pull-through cache: it serves from local disk and on a
+// miss fetches from upstream, streaming the output to the client while
+// storing it locally.
+type proxyStorage struct {
+	*localStorage
+	disk      *cachers.SimpleDiskCache
+	upstream  cachers.RemoteCache
+	writeMode string
+	verbose   bool
+	// filled, if set, is called for outputs stored locally from upstream.
+	filled func(actionID, outputID string, size int64)
+
+	queue chan pendingUpload // write-back uploads
+	wg    sync.WaitGroup     // write-back workers
+}
+
+type pendingUpload struct {
+	actionID, outputID, diskPath string
+	size                         int64
+}
+
+func newProxyStorage(disk *cachers.SimpleDiskCache, upstream cachers.RemoteCache, writeMode string, verbose bool) (*proxyStorage, error) {
+	switch writeMode {
+	case writeThrough, writeBack, writeNone:
+	default:
+		return nil, fmt.Errorf("unknown upstream write mode %q", writeMode)
+	}
+	return &proxyStorage{
+		localStorage: newLocalStorage(disk),
+		disk:         disk,
+		upstream:     upstream,
+		writeMode:    writeMode,
+		verbose:      verbose,
+	}, nil
+}
+
+func (p *proxyStorage) Kind() string {
+	return "proxy"
+}
+
+func (p *proxyStorage) Start(ctx context.Context) error {
+	if err := p.disk.Start(ctx); err != nil {
+		return fmt.Errorf("local cache start failed: %w", err)
+	}
+	if err := p.upstream.Start(ctx); err != nil {
+		_ = p.disk.Close()
+		return fmt.Errorf("upstream start failed: %w", err)
+	}
+	if p.writeMode == writeBack {
+		p.queue = make(chan pendingUpload, writeBackQueueSize)
+		for range writeBackWorkers {
+			p.wg.Add(1)
+			go p.uploadLoop()
+		}
+	}
+	return nil
+}
+
+// Close waits for pending write-back uploads.
+func (p *proxyStorage) Close() error {
+	if p.queue != nil {
+		close(p.queue)
+		p.wg.Wait()
+	}
+	return errors.Join(p.disk.Close(), p.upstream.Close())
+}
+
+func (p *proxyStorage) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	outputID, size, body, err := p.localStorage.Get(ctx, actionID)
+	if err != nil || outputID != "" {
+		return outputID, size, body, err
+	}
+	outputID, size, body, err = p.upstream.Get(ctx, actionID)
+	if err != nil {
+		// An unreachable upstream shouldn't take the local cache down.
+		log.Printf("[%s]\tupstream get of action %s: %v", p.Kind(), actionID, err)
+		return "", 0, nil, nil
+	}
+	if outputID == "" {
+		return "", 0, nil, nil
+	}
+	p.outputs.add(outputID, actionID)
+	return outputID, size, p.fill(actionID, outputID, size, body), nil
+}
+
+func (p *proxyStorage) GetOutput(ctx context.Context, outputID string) (int64, io.ReadCloser, error) {
+	diskPath, err := p.disk.GetOutput(ctx, outputID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if diskPath != "" {
+		size, f, err := openOutput(diskPath)
+		if err != nil {
+			return 0, nil, err
+		}
+		if f != nil {
+			return size, f, nil
+		}
+	}
+	return p.outputs.getOutput(ctx, outputID, p.Get)
+}
+
+func (p *proxyStorage) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	diskPath, err := p.disk.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", err
+	}
+	up := pendingUpload{actionID: actionID, outputID: outputID, diskPath: diskPath, size: size}
+	switch p.writeMode {
+	case writeThrough:
+		// Like CombinedCache, upstream failures don't fail the put.
+		p.upload(ctx, up)
+	case writeBack:
+		select {
+		case p.queue <- up:
+		default:
+			log.Printf("[%s]\twrite-back queue full; not uploading action %s", p.Kind(), actionID)
+		}
+	}
+	return diskPath, nil
+}
+
+func (p *proxyStorage) uploadLoop() {
+	defer p.wg.Done()
+	for up := range p.queue {
+		p.upload(context.Background(), up)
+	}
+}
+
+// upload copies the output stored at up.diskPath to upstream.
+func (p *proxyStorage) upload(ctx context.Context, up pendingUpload) {
+	f, err := os.Open(up.diskPath)
+	if err == nil {
+		err = p.upstream.Put(ctx, up.actionID, up.outputID, up.size, f)
+		_ = f.Close()
+	}
+	if err != nil {
+		log.Printf("[%s]\tuploading action %s upstream: %v", p.Kind(), up.actionID, err)
+	} else if p.verbose {
+		log.Printf("[%s]\tuploaded action %s upstream", p.Kind(), up.actionID)
+	}
+}
+
+// fill returns a reader of the upstream output body that also stores it
+// on local disk.
+func (p *proxyStorage) fill(actionID, outputID string, size int64, body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	fr := &fillReader{body: body, pw: pw, size: size}
+	go func() {
+		_, err := p.disk.Put(context.Background(), actionID, outputID, size, pr)
+		// Unblocks the writer if the put failed early.
+		_ = pr.CloseWithError(errors.Join(err, io.ErrClosedPipe))
+		if err == nil && p.filled != nil {
+			p.filled(actionID, outputID, size)
+		}
+		if err != nil && p.verbose {
+			log.Printf("[%s]\tstoring action %s locally: %v", p.Kind(), actionID, err)
+		}
+	}()
+	return fr
+}
+
+// fillReader tees an upstream output into a local put.
+type fillReader struct {
+	body io.ReadCloser
+	pw   *io.PipeWriter
+	size int64
+	read int64
+
+	teeErr error // stops teeing once the local put failed
+}
+
+func (fr *fillReader) Read(b []byte) (int, error) {
+	n, err := fr.body.Read(b)
+	fr.read += int64(n)
+	if n > 0 && fr.teeErr == nil {
+		_, fr.teeErr = fr.pw.Write(b[:n])
+	}
+	return n, err
+}
+
+// Close finishes the local copy in the background if the client stopped
+// reading early, as it does when it only wanted the action's metadata.
+func (fr *fillReader) Close() error {
+	if fr.read < fr.size && fr.teeErr == nil {
+		go func() {
+			n, err := io.Copy(fr.pw, fr.body)
+			fr.closePipe(fr.read+n, err)
+			_ = fr.body.Close()
+		}()
+		return nil
+	}
+	fr.closePipe(fr.read, nil)
+	return fr.body.Close()
+}
+
+// closePipe ends the local put, failing it unless exactly size bytes were
+// copied so no partial output is left behind.
+func (fr *fillReader) closePipe(n int64, err error) {
+	if err == nil && n != fr.size {
+		err = fmt.Errorf("upstream sent %d bytes, want %d", n, fr.size)
+	}
+	_ = fr.pw.CloseWithError(err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestProxy(t *testing.T) {
+	for _, mode := range []string{writeThrough, writeBack} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			upstreamSrv := newTestServer(t)
+			upstream := httptest.NewServer(upstreamSrv)
+			defer upstream.Close()
+
+			d := t.TempDir()
+			ps, err := newProxyStorage(cachers.NewSimpleDiskCache(false, d),
+				cachers.NewHttpCache(upstream.URL, cachers.HTTPCacheOptions{}, false), mode, false)
+			require.NoError(t, err)
+			require.NoError(t, ps.Start(ctx))
+			ts := httptest.NewServer(&server{store: ps, dir: d})
+			defer ts.Close()
+			c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+
+			// Misses are filled from upstream.
+			upc := cachers.NewHttpCache(upstream.URL, cachers.HTTPCacheOptions{}, false)
+			body := strings.Repeat("x", 5000)
+			require.NoError(t, upc.Put(ctx, testActionID, testOutputID, int64(len(body)), strings.NewReader(body)))
+			outputID, got, err := getString(t, c, testActionID)
+			require.NoError(t, err)
+			assert.Equal(t, testOutputID, outputID)
+			assert.Equal(t, body, got)
+			assert.Eventually(t, func() bool {
+				b, err := os.ReadFile(filepath.Join(d, "o-"+testOutputID))
+				return err == nil && string(b) == body
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// Puts reach upstream.
+			const actionID, outputID2 = "cccc", "dddd"
+			require.NoError(t, c.Put(ctx, actionID, outputID2, 2, strings.NewReader("hi")))
+			require.NoError(t, ps.Close()) // waits for write-back
+			outputID, got, err = getString(t, upc, actionID)
+			require.NoError(t, err)
+			assert.Equal(t, outputID2, outputID)
+			assert.Equal(t, "hi", got)
+		})
+	}
+}
+
+func TestProxyPartialRead(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(newTestServer(t))
+	defer upstream.Close()
+	upc := cachers.NewHttpCache(upstream.URL, cachers.HTTPCacheOptions{}, false)
+	require.NoError(t, upc.Put(ctx, testActionID, testOutputID, 5, strings.NewReader("hello")))
+
+	d := t.TempDir()
+	ps, err := newProxyStorage(cachers.NewSimpleDiskCache(false, d), upc, writeNone, false)
+	require.NoError(t, err)
+	require.NoError(t, ps.Start(ctx))
+	defer ps.Close() //nolint:errcheck
+
+	// A lookup that doesn't read the output still fills the local cache.
+	outputID, _, body, err := ps.Get(ctx, testActionID)
+	require.NoError(t, err)
+	assert.Equal(t, testOutputID, outputID)
+	require.NoError(t, body.Close())
+	assert.Eventually(t, func() bool {
+		outputID, diskPath, err := ps.disk.Get(ctx, testActionID)
+		return err == nil && outputID == testOutputID && diskPath != ""
+	}, 5*time.Second, 10*time.Millisecond)
+}
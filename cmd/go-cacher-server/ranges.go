@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// outputMaxAge is the Cache-Control max-age of outputs, which never change.
+const outputMaxAge = 365 * 24 * 60 * 60
+
+// outputETag is the entity tag of output outputID sent with comp, or as is
+// if comp is empty.
+func outputETag(outputID, comp string) string {
+	if comp == "" {
+		return `"` + outputID + `"`
+	}
+	return `"` + outputID + "+" + comp + `"`
+}
+
+// setCacheControl sets the Cache-Control of a response. Immutable responses
+// are outputs; others may change and must be revalidated. Responses to
+// authenticated requests are kept out of shared caches.
+func (s *server) setCacheControl(w http.ResponseWriter, immutable bool) {
+	cc := "no-cache"
+	if immutable {
+		cc = fmt.Sprintf("max-age=%d, immutable", outputMaxAge)
+	}
+	if s.auth != nil {
+		cc = "private, " + cc
+	} else if immutable {
+		cc = "public, " + cc
+	}
+	w.Header().Set("Cache-Control", cc)
+}
+
+// etagMatches reports whether the list of entity tags in header, as in
+// If-None-Match, matches etag using the weak comparison.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses a Range header for an output of size bytes. It returns
+// ok false if the header isn't a single byte range, which callers ignore,
+// and satisfiable false if it's one outside the output.
+func parseRange(header string, size int64) (start, length int64, ok, satisfiable bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// The last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// requestedRange returns the byte range of an output with entity tag etag
+// and size bytes that r asks for, if any. If the range can't be satisfied
+// it writes a 416 response and returns handled true.
+func requestedRange(w http.ResponseWriter, r *http.Request, etag string, size int64) (start, length int64, partial, handled bool) {
+	header := r.Header.Get("Range")
+	if header == "" || (r.Method != "GET" && r.Method != "HEAD") {
+		return 0, 0, false, false
+	}
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != etag {
+		// The client's copy is of something else; send all of it.
+		return 0, 0, false, false
+	}
+	start, length, ok, satisfiable := parseRange(header, size)
+	if !ok {
+		return 0, 0, false, false
+	}
+	if !satisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return 0, 0, false, true
+	}
+	return start, length, true, false
+}
+
+// skip discards the first n bytes of body.
+func skip(body io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if sk, ok := body.(io.Seeker); ok {
+		_, err := sk.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, body, n)
+	return err
+}
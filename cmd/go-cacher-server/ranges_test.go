@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestHTTPCachingSemantics(t *testing.T) {
+	srv := newTestServer(t)
+	srv.compressions = []*cachers.Compression{cachers.LookupCompression("gzip")}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	body := strings.Repeat("0123456789", 200)
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	require.NoError(t, c.Put(context.Background(), testActionID, testOutputID, int64(len(body)), strings.NewReader(body)))
+
+	tr := &http.Transport{DisableCompression: true}
+	defer tr.CloseIdleConnections()
+	do := func(method, path string, hdr ...string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		res, err := tr.RoundTrip(req)
+		require.NoError(t, err)
+		defer res.Body.Close() //nolint:errcheck
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(b)
+	}
+	outputPath := "/output/" + testOutputID
+	etag := `"` + testOutputID + `"`
+
+	res, got := do("GET", outputPath)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, body, got)
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+	assert.Equal(t, "public, max-age=31536000, immutable", res.Header.Get("Cache-Control"))
+
+	res, _ = do("GET", outputPath, "Accept-Encoding", "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"`+testOutputID+`+gzip"`, res.Header.Get("ETag"))
+
+	res, got = do("GET", outputPath, "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Empty(t, got)
+
+	res, got = do("HEAD", outputPath)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "2000", res.Header.Get("Content-Length"))
+	assert.Empty(t, got)
+
+	for _, tt := range []struct {
+		rng, want, contentRange string
+	}{
+		{"bytes=10-14", "01234", "bytes 10-14/2000"},
+		{"bytes=1995-", "56789", "bytes 1995-1999/2000"},
+		{"bytes=-3", "789", "bytes 1997-1999/2000"},
+		{"bytes=1998-5000", "89", "bytes 1998-1999/2000"},
+	} {
+		res, got = do("GET", outputPath, "Range", tt.rng, "Accept-Encoding", "gzip")
+		assert.Equal(t, http.StatusPartialContent, res.StatusCode, tt.rng)
+		assert.Equal(t, tt.want, got, tt.rng)
+		assert.Equal(t, tt.contentRange, res.Header.Get("Content-Range"), tt.rng)
+	}
+	res, _ = do("GET", outputPath, "Range", "bytes=2000-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, res.StatusCode)
+	assert.Equal(t, "bytes */2000", res.Header.Get("Content-Range"))
+	res, got = do("GET", outputPath, "Range", "bytes=0-1,5-6")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, body, got)
+	res, got = do("GET", outputPath, "Range", "bytes=0-1", "If-Range", `"other"`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, body, got)
+
+	// Action lookups, in both representations.
+	actionPath := "/action/" + testActionID
+	for _, accept := range []string{"", cachers.ContentTypeOutput} {
+		res, got = do("HEAD", actionPath, "Accept", accept)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Empty(t, got)
+		assert.Equal(t, testOutputID, res.Header.Get(cachers.HeaderOutputID))
+		assert.Equal(t, "2000", res.Header.Get(cachers.HeaderOutputSize))
+		assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	}
+	res, got = do("GET", actionPath, "Accept", cachers.ContentTypeOutput, "Range", "bytes=5-9")
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, "56789", got)
+	res, _ = do("HEAD", "/action/cccc")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	// Only the whole lookups count as hits; outputs and ranges don't.
+	assert.EqualValues(t, 2, srv.metrics.hits.Load())
+	assert.EqualValues(t, 1, srv.metrics.misses.Load())
+}
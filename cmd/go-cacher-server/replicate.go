@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// headerReplica marks puts made by replication. The receiving server stores
+// them without replicating them further, so that peers replicating to each
+// other don't send puts around in circles.
+const headerReplica = "X-Cache-Replica"
+
+const (
+	replicationQueueSize = 1024
+	replicationWorkers   = 4
+	syncPageSize         = 1000
+	// syncOverlap widens incremental syncs to the entries stored while
+	// the previous sync ran.
+	syncOverlap = time.Minute
+)
+
+// replicatorOptions configures newReplicator.
+type replicatorOptions struct {
+	Peers        []string         // base URLs of the peer servers
+	Auth         cachers.HTTPAuth // needs read, write and admin scope on the peers
+	TLSConfig    *tls.Config      // optionally configures HTTPS to the peers
+	SyncInterval time.Duration    // how often to pull missed entries; zero disables it
+	Verbose      bool
+}
+
+// replicator keeps a server's peers populated: puts from clients are copied
+// to every peer in the background, and entries the server missed, for
+// instance while it was down, are periodically pulled from the peers
+// (anti-entropy). Its methods are no-ops on a nil *replicator.
+type replicator struct {
+	srv          *server
+	peers        []*peer
+	queue        chan replication
+	syncInterval time.Duration
+	verbose      bool
+	wg           sync.WaitGroup     // push workers
+	syncing      sync.WaitGroup     // sync loops
+	stopSync     context.CancelFunc // stops the sync loops; nil before start
+	abandon      context.CancelFunc // cancels pushes; nil before start
+
+	mu     sync.Mutex
+	closed bool // guarded by mu; queue is closed
+}
+
+// peer is another go-cacher-server that a replicator keeps in sync with.
+type peer struct {
+	baseURL string // including the namespace, if any
+	cache   *cachers.HTTPCache
+
+	// syncFile remembers lastSync across restarts, see syncFileName.
+	// Empty if the server has no disk directory.
+	syncFile string
+
+	// lastSync is when the last successful sync started, or zero before
+	// the first one. Only used by syncLoop.
+	lastSync time.Time
+}
+
+type replication struct {
+	actionID, outputID string
+}
+
+func newReplicator(srv *server, opts replicatorOptions) *replicator {
+	if len(opts.Peers) == 0 {
+		return nil
+	}
+	rp := &replicator{
+		srv:          srv,
+		queue:        make(chan replication, replicationQueueSize),
+		syncInterval: opts.SyncInterval,
+		verbose:      opts.Verbose,
+	}
+	for _, u := range opts.Peers {
+		base := strings.TrimSuffix(u, "/")
+		if srv.namespace != "" {
+			base += "/ns/" + url.PathEscape(srv.namespace)
+		}
+		p := &peer{
+			baseURL: base,
+			cache: cachers.NewHttpCache(u, cachers.HTTPCacheOptions{
+				Namespace: srv.namespace,
+				Auth:      opts.Auth,
+				Header:    http.Header{headerReplica: {"1"}},
+				TLSConfig: opts.TLSConfig,
+			}, opts.Verbose),
+		}
+		if srv.dir != "" {
+			p.syncFile = filepath.Join(srv.dir, syncFileName(base))
+			p.lastSync = readSyncFile(p.syncFile)
+		}
+		rp.peers = append(rp.peers, p)
+	}
+	return rp
+}
+
+// syncFileName returns the name of the file in the server's directory that
+// remembers when the peer at baseURL was last synced, so that a restarted
+// server doesn't pull back in everything it evicted.
+func syncFileName(baseURL string) string {
+	sum := sha256.Sum256([]byte(baseURL))
+	return fmt.Sprintf("peer-sync-%x", sum[:8])
+}
+
+// readSyncFile returns the time stored in file, or zero if there's none.
+func readSyncFile(file string) time.Time {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	if err != nil {
+		log.Printf("ignoring %s: %v", file, err)
+		return time.Time{}
+	}
+	return t
+}
+
+// setLastSync records that the sync from p that started at t succeeded.
+func (p *peer) setLastSync(t time.Time) {
+	p.lastSync = t
+	if p.syncFile == "" {
+		return
+	}
+	if err := os.WriteFile(p.syncFile, []byte(t.Format(time.RFC3339Nano)+"\n"), 0644); err != nil {
+		log.Printf("saving sync time of %s: %v", p.baseURL, err)
+	}
+}
+
+// start starts the background work, which runs until ctx is done or close
+// stops it.
+func (rp *replicator) start(ctx context.Context) {
+	if rp == nil {
+		return
+	}
+	pushCtx, abandon := context.WithCancel(ctx)
+	syncCtx, stopSync := context.WithCancel(ctx)
+	rp.abandon, rp.stopSync = abandon, stopSync
+	for range replicationWorkers {
+		rp.wg.Add(1)
+		go func() {
+			defer rp.wg.Done()
+			for it := range rp.queue {
+				if pushCtx.Err() == nil {
+					rp.push(pushCtx, it)
+				}
+			}
+		}()
+	}
+	if rp.syncInterval > 0 {
+		for _, p := range rp.peers {
+			rp.syncing.Add(1)
+			go func() {
+				defer rp.syncing.Done()
+				rp.syncLoop(syncCtx, p)
+			}()
+		}
+	}
+}
+
+// close stops the sync loops and accepting puts, and waits up to timeout
+// for the queued puts to be sent. Those left are dropped.
+func (rp *replicator) close(timeout time.Duration) {
+	if rp == nil {
+		return
+	}
+	if rp.stopSync != nil {
+		rp.stopSync()
+	}
+	rp.syncing.Wait()
+	rp.mu.Lock()
+	if !rp.closed {
+		rp.closed = true
+		close(rp.queue)
+	}
+	rp.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		rp.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	log.Printf("replication: dropping %d queued puts after %v", len(rp.queue), timeout)
+	if rp.abandon != nil {
+		rp.abandon()
+	}
+	<-done
+}
+
+// replicate queues actionID for copying to the peers. If the queue is full
+// the put is dropped; anti-entropy will catch up on it.
+func (rp *replicator) replicate(actionID, outputID string) {
+	if rp == nil {
+		return
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.closed {
+		return
+	}
+	select {
+	case rp.queue <- replication{actionID, outputID}:
+	default:
+		rp.srv.metrics.replicationErrors.Add(int64(len(rp.peers)))
+		if rp.verbose {
+			log.Printf("replication queue full, dropping %s", actionID)
+		}
+	}
+}
+
+// push sends one put to every peer.
+func (rp *replicator) push(ctx context.Context, it replication) {
+	for _, p := range rp.peers {
+		outputID, size, body, err := rp.srv.store.Get(ctx, it.actionID)
+		if err != nil || outputID != it.outputID {
+			// Evicted or replaced since; nothing to send.
+			if body != nil {
+				_ = body.Close()
+			}
+			return
+		}
+		err = p.cache.Put(ctx, it.actionID, outputID, size, body)
+		_ = body.Close()
+		if err != nil {
+			rp.srv.metrics.replicationErrors.Add(1)
+			if rp.verbose {
+				log.Printf("replicating %s to %s: %v", it.actionID, p.baseURL, err)
+			}
+			continue
+		}
+		rp.srv.metrics.replicated.Add(1)
+	}
+}
+
+// syncLoop pulls the entries missing locally from p, right away and then
+// every syncInterval. After the first full sync only entries stored since
+// the previous sync are considered, so entries evicted here aren't pulled
+// back in, also not after a restart.
+func (rp *replicator) syncLoop(ctx context.Context, p *peer) {
+	for {
+		start := time.Now()
+		n, err := rp.sync(ctx, p)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("sync from %s: %v", p.baseURL, err)
+		default:
+			p.setLastSync(start)
+			if rp.verbose || n > 0 {
+				log.Printf("synced %d entries from %s", n, p.baseURL)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rp.syncInterval):
+		}
+	}
+}
+
+// sync copies the entries p has and the server lacks, returning how many.
+func (rp *replicator) sync(ctx context.Context, p *peer) (n int, err error) {
+	q := url.Values{"limit": {strconv.Itoa(syncPageSize)}}
+	if !p.lastSync.IsZero() {
+		q.Set("max_age", (time.Since(p.lastSync) + syncOverlap).String())
+	}
+	for {
+		page, err := p.listEntries(ctx, q)
+		if err != nil {
+			return n, err
+		}
+		for _, e := range page.Entries {
+			if rp.has(ctx, e) {
+				continue
+			}
+			ok, err := rp.fetch(ctx, p, e.ActionID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return n, err
+				}
+				// Skip entries we can't take, like ones too large.
+				rp.srv.metrics.replicationErrors.Add(1)
+				if rp.verbose {
+					log.Printf("sync of %s from %s: %v", e.ActionID, p.baseURL, err)
+				}
+				continue
+			}
+			if ok {
+				n++
+			}
+		}
+		if page.Next == "" {
+			return n, nil
+		}
+		q.Set("cursor", page.Next)
+	}
+}
+
+// has reports whether the server has e's output for e's action.
+func (rp *replicator) has(ctx context.Context, e cachers.Entry) bool {
+	if ac := rp.srv.store.Admin(); ac != nil {
+		got, ok, err := ac.Stat(ctx, e.ActionID)
+		return err == nil && ok && got.OutputID == e.OutputID
+	}
+	outputID, _, body, err := rp.srv.store.Get(ctx, e.ActionID)
+	if body != nil {
+		_ = body.Close()
+	}
+	return err == nil && outputID == e.OutputID
+}
+
+// fetch copies actionID from p. It reports false if p no longer has it.
+func (rp *replicator) fetch(ctx context.Context, p *peer, actionID string) (bool, error) {
+	outputID, size, body, err := p.cache.Get(ctx, actionID)
+	if err != nil || outputID == "" {
+		return false, err
+	}
+	defer body.Close() //nolint:errcheck
+	if err := rp.srv.storeOutput(ctx, actionID, outputID, size, body); err != nil {
+		if errors.Is(err, errOutputMismatch) {
+			rp.srv.metrics.rejected.Add(1)
+		}
+		return false, err
+	}
+	rp.srv.metrics.synced.Add(1)
+	return true, nil
+}
+
+// listEntries returns a page of p's GET /admin/entries.
+func (p *peer) listEntries(ctx context.Context, q url.Values) (*AdminListResponse, error) {
+	res, err := p.cache.Do(ctx, "GET", "/admin/entries?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() //nolint:errcheck
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("listing entries: %v: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	var page AdminListResponse
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
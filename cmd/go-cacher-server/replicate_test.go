@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestReplication(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("peer read,write,admin\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	auth := cachers.BearerTokenAuth{Token: "peer"}
+	ctx := context.Background()
+
+	newPeer := func() (*server, *httptest.Server) {
+		srv := newTestServer(t)
+		srv.auth = ta
+		ts := httptest.NewServer(srv)
+		t.Cleanup(ts.Close)
+		return srv, ts
+	}
+	a, tsA := newPeer()
+	b, tsB := newPeer()
+	a.replicas = newReplicator(a, replicatorOptions{Peers: []string{tsB.URL}, Auth: auth})
+	b.replicas = newReplicator(b, replicatorOptions{Peers: []string{tsA.URL}, Auth: auth})
+	a.replicas.start(ctx)
+	b.replicas.start(ctx)
+
+	ca := cachers.NewHttpCache(tsA.URL, cachers.HTTPCacheOptions{Auth: auth}, false)
+	cb := cachers.NewHttpCache(tsB.URL, cachers.HTTPCacheOptions{Auth: auth}, false)
+	require.NoError(t, ca.Put(ctx, "a001", "b001", 5, strings.NewReader("hello")))
+	require.Eventually(t, func() bool {
+		outputID, _, _ := getString(t, cb, "a001")
+		return outputID == "b001"
+	}, 5*time.Second, 10*time.Millisecond)
+	_, body, err := getString(t, cb, "a001")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", body)
+
+	// The copy on b isn't sent back to a.
+	a.replicas.close(time.Minute)
+	b.replicas.close(time.Minute)
+	assert.Equal(t, int64(1), a.metrics.replicated.Load())
+	assert.Equal(t, int64(0), b.metrics.replicated.Load())
+
+	// c was down while a got more puts, and catches up from a.
+	for i := 2; i <= 5; i++ {
+		body := fmt.Sprintf("body %d", i)
+		require.NoError(t, ca.Put(ctx, fmt.Sprintf("a%03d", i), fmt.Sprintf("b%03d", i), int64(len(body)), strings.NewReader(body)))
+	}
+	c, tsC := newPeer()
+	c.replicas = newReplicator(c, replicatorOptions{Peers: []string{tsA.URL}, Auth: auth})
+	p := c.replicas.peers[0]
+	n, err := c.replicas.sync(ctx, p)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	cc := cachers.NewHttpCache(tsC.URL, cachers.HTTPCacheOptions{Auth: auth}, false)
+	for i := 1; i <= 5; i++ {
+		outputID, _, err := getString(t, cc, fmt.Sprintf("a%03d", i))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("b%03d", i), outputID)
+	}
+	n, err = c.replicas.sync(ctx, p)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "nothing new to sync")
+	assert.Equal(t, int64(5), c.metrics.synced.Load())
+}
+
+func TestReplicationTLS(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("peer read,write,admin\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	auth := cachers.BearerTokenAuth{Token: "peer"}
+	ctx := context.Background()
+
+	b := newTestServer(t)
+	b.auth = ta
+	tsB := httptest.NewTLSServer(b)
+	defer tsB.Close()
+	_, err = b.store.Put(ctx, "a001", "b001", 5, strings.NewReader("hello"))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(tsB.Certificate())
+
+	a := newTestServer(t)
+	a.replicas = newReplicator(a, replicatorOptions{
+		Peers:     []string{tsB.URL},
+		Auth:      auth,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+	n, err := a.replicas.sync(ctx, a.replicas.peers[0])
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = a.store.Put(ctx, "a002", "b002", 5, strings.NewReader("world"))
+	require.NoError(t, err)
+	a.replicas.start(ctx)
+	a.replicas.replicate("a002", "b002")
+	a.replicas.close(time.Minute)
+	assert.Equal(t, int64(1), a.metrics.replicated.Load())
+	outputID, _, body, err := b.store.Get(ctx, "a002")
+	require.NoError(t, err)
+	defer body.Close() //nolint:errcheck
+	assert.Equal(t, "b002", outputID)
+}
+
+func TestReplicationSyncFile(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"entries":[]}`)
+	}))
+	defer peer.Close()
+	srv := newTestServer(t)
+	opts := replicatorOptions{Peers: []string{peer.URL}, SyncInterval: time.Hour}
+	srv.replicas = newReplicator(srv, opts)
+	p := srv.replicas.peers[0]
+	assert.True(t, p.lastSync.IsZero())
+	srv.replicas.start(context.Background())
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(p.syncFile)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	srv.replicas.close(time.Minute)
+
+	// A restarted server continues where the last sync left off.
+	again := newReplicator(srv, opts)
+	assert.Equal(t, p.syncFile, again.peers[0].syncFile)
+	assert.True(t, again.peers[0].lastSync.Equal(p.lastSync), "got %v, want %v", again.peers[0].lastSync, p.lastSync)
+}
+
+func TestReplicationCloseTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer peer.Close()
+	defer close(stuck)
+	srv := newTestServer(t)
+	srv.replicas = newReplicator(srv, replicatorOptions{Peers: []string{peer.URL}, SyncInterval: time.Hour})
+	srv.replicas.start(context.Background())
+	ctx := context.Background()
+	for i := range 10 {
+		actionID := fmt.Sprintf("a%03d", i)
+		_, err := srv.store.Put(ctx, actionID, "b001", 5, strings.NewReader("hello"))
+		require.NoError(t, err)
+		srv.replicas.replicate(actionID, "b001")
+	}
+
+	start := time.Now()
+	srv.replicas.close(100 * time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+var (
+	errNoScrub      = errors.New("storage backend doesn't support scrubbing")
+	errScrubRunning = errors.New("a scrub is already running")
+)
+
+// scrub checks s's stored entries, see cachers.SimpleDiskCache.Scrub, and
+// stops tracking what it removed. Only one scrub runs at a time.
+func (s *server) scrub(ctx context.Context, dryRun bool) (*cachers.ScrubReport, error) {
+	sc, ok := s.store.Admin().(cachers.Scrubber)
+	if !ok {
+		return nil, errNoScrub
+	}
+	if !s.scrubbing.TryLock() {
+		return nil, errScrubRunning
+	}
+	defer s.scrubbing.Unlock()
+	rep, err := sc.Scrub(ctx, cachers.ScrubOptions{Rate: s.scrubRate, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.scrubbed.Add(rep.Bytes)
+	s.metrics.scrubProblems.Add(int64(len(rep.Problems)))
+	for _, p := range rep.Problems {
+		log.Printf("scrub%s: %s %s%s: %s (removed: %v)", s.logNamespace(), p.Kind, p.ActionID, p.OutputID, p.Detail, p.Removed)
+		if !p.Removed {
+			continue
+		}
+		if p.ActionID != "" {
+			s.metrics.removed.Add(1)
+			s.evict.forget(p.ActionID)
+		} else {
+			s.removeCompressedCopies(p.OutputID)
+		}
+	}
+	return rep, nil
+}
+
+// repair removes what processes killed mid-write left in s's store, see
+// cachers.SimpleDiskCache.Repair, and stops tracking the index entries it
+// removed. It runs once the evictor has loaded the store, so that those
+// entries don't stay counted.
+func (s *server) repair(ctx context.Context) {
+	r, ok := s.store.Admin().(cachers.Repairer)
+	if !ok || s.staleTempAge < 0 {
+		return
+	}
+	age := cmp.Or(s.staleTempAge, cachers.DefaultStaleTempAge)
+	temps, dangling, err := r.Repair(ctx, age, func(actionID string) {
+		s.metrics.removed.Add(1)
+		if outputID := s.evict.forget(actionID); outputID != "" {
+			s.removeCompressedCopies(outputID)
+		}
+	})
+	switch {
+	case err != nil && ctx.Err() == nil:
+		log.Printf("repair%s: %v", s.logNamespace(), err)
+	case s.verbose || temps > 0 || dangling > 0:
+		log.Printf("repair%s: removed %d stale temp files and %d dangling index entries", s.logNamespace(), temps, dangling)
+	}
+}
+
+// scrubLoop scrubs s every interval until ctx is done.
+func (s *server) scrubLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		rep, err := s.scrub(ctx, false)
+		switch {
+		case errors.Is(err, errScrubRunning):
+		case err != nil:
+			if ctx.Err() == nil {
+				log.Printf("scrub%s: %v", s.logNamespace(), err)
+			}
+		default:
+			log.Printf("scrub%s: checked %d entries and %d outputs (%d bytes) in %v, found %d problems",
+				s.logNamespace(), rep.Entries, rep.Outputs, rep.Bytes, rep.Duration.Round(time.Second), len(rep.Problems))
+		}
+	}
+}
+
+// logNamespace names s's namespace in log messages.
+func (s *server) logNamespace() string {
+	if s.namespace == "" {
+		return ""
+	}
+	return " of namespace " + s.namespace
+}
+
+// handleAdminScrub serves POST /admin/scrub, which scrubs right away and
+// returns the report. With dry_run=1, nothing is removed.
+func (s *server) handleAdminScrub(w http.ResponseWriter, r *http.Request) {
+	rep, err := s.scrub(r.Context(), r.URL.Query().Get("dry_run") == "1")
+	switch {
+	case errors.Is(err, errNoScrub):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, errScrubRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, rep)
+	}
+}
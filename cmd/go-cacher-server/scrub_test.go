@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestScrub(t *testing.T) {
+	srv := newTestServer(t)
+	srv.verifyOutputs = true
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rw read,write\nops admin\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	srv.auth = ta
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: "rw"}}, false)
+	ctx := context.Background()
+	var outputIDs []string
+	for _, body := range []string{"intact", "bit rot"} {
+		sum := sha256.Sum256([]byte(body))
+		outputID := hex.EncodeToString(sum[:])
+		outputIDs = append(outputIDs, outputID)
+		require.NoError(t, c.Put(ctx, outputID[:8], outputID, int64(len(body)), strings.NewReader(body)))
+	}
+	rotten := outputIDs[1]
+	require.NoError(t, os.WriteFile(filepath.Join(srv.dir, "o-"+rotten), []byte("bit r0t"), 0644))
+
+	scrub := func(query string) (*cachers.ScrubReport, int) {
+		req, err := http.NewRequest("POST", ts.URL+"/admin/scrub"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer ops")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() //nolint:errcheck
+		var rep cachers.ScrubReport
+		if res.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&rep))
+		}
+		return &rep, res.StatusCode
+	}
+
+	rep, code := scrub("?dry_run=1")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, rep.Problems, 2)
+	assert.False(t, rep.Problems[0].Removed)
+	outputID, _, err := getString(t, c, rotten[:8])
+	require.NoError(t, err)
+	assert.Equal(t, rotten, outputID, "dry runs remove nothing")
+
+	rep, code = scrub("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, rep.Entries)
+	assert.Equal(t, 2, rep.Outputs)
+	require.Len(t, rep.Problems, 2)
+	assert.Equal(t, cachers.ScrubCorruptOutput, rep.Problems[0].Kind)
+	assert.Equal(t, cachers.ScrubDanglingIndex, rep.Problems[1].Kind)
+	outputID, _, err = getString(t, c, rotten[:8])
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+	_, body, err := getString(t, c, outputIDs[0][:8])
+	require.NoError(t, err)
+	assert.Equal(t, "intact", body)
+	assert.Equal(t, int64(4), srv.metrics.scrubProblems.Load())
+	assert.Equal(t, int64(1), srv.metrics.removed.Load())
+
+	srv.scrubbing.Lock()
+	_, code = scrub("")
+	srv.scrubbing.Unlock()
+	assert.Equal(t, http.StatusConflict, code)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const (
+	testActionID = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	testOutputID = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	d := t.TempDir()
+	return &server{store: newLocalStorage(cachers.NewSimpleDiskCache(false, d)), dir: d}
+}
+
+func getString(t *testing.T, c cachers.RemoteCache, actionID string) (outputID, body string, err error) {
+	t.Helper()
+	outputID, _, rc, err := c.Get(context.Background(), actionID)
+	if err != nil || outputID == "" {
+		return outputID, "", err
+	}
+	defer rc.Close() //nolint:errcheck
+	b, err := io.ReadAll(rc)
+	return outputID, string(b), err
+}
+
+func TestTokenAuth(t *testing.T) {
+	srv := newTestServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("# test tokens\nreader read\nwriter read,write ci\n"), 0600))
+	ta, err := loadTokenFile(tokenFile)
+	require.NoError(t, err)
+	srv.auth = ta
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	writer := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BearerTokenAuth{Token: "writer"}}, false)
+	reader := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Auth: cachers.BasicAuth{Username: "x", Password: "reader"}}, false)
+	anon := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+
+	body := "hello"
+	require.NoError(t, writer.Put(context.Background(), testActionID, testOutputID, int64(len(body)), bytes.NewReader([]byte(body))))
+
+	err = reader.Put(context.Background(), testActionID, testOutputID, int64(len(body)), bytes.NewReader([]byte(body)))
+	assert.ErrorIs(t, err, cachers.ErrForbidden)
+
+	outputID, got, err := getString(t, reader, testActionID)
+	require.NoError(t, err)
+	assert.Equal(t, testOutputID, outputID)
+	assert.Equal(t, body, got)
+
+	_, _, err = getString(t, anon, testActionID)
+	assert.ErrorIs(t, err, cachers.ErrUnauthorized)
+}
+
+func TestSingleRoundTripLookup(t *testing.T) {
+	srv := newTestServer(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+
+	for _, body := range []string{"", "hello"} {
+		require.NoError(t, c.Put(context.Background(), testActionID, testOutputID, int64(len(body)), bytes.NewReader([]byte(body))))
+		requests.Store(0)
+		outputID, got, err := getString(t, c, testActionID)
+		require.NoError(t, err)
+		assert.Equal(t, testOutputID, outputID)
+		assert.Equal(t, body, got)
+		assert.Equal(t, int32(1), requests.Load())
+	}
+
+	outputID, _, err := getString(t, c, testOutputID)
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+}
+
+func TestBatchGet(t *testing.T) {
+	srv := newTestServer(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+
+	// Entries 0-9 are cached, 10-19 are not.
+	actionID := func(i int) string { return fmt.Sprintf("%064x", i) }
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{BatchWindow: 50 * time.Millisecond}, false)
+	for i := range 10 {
+		body := strings.Repeat("x", i)
+		require.NoError(t, c.Put(ctx, actionID(i), actionID(100+i), int64(i), strings.NewReader(body)))
+	}
+	requests.Store(0)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputID, got, err := getString(t, c, actionID(i))
+			assert.NoError(t, err)
+			if i < 10 {
+				assert.Equal(t, actionID(100+i), outputID)
+				assert.Equal(t, strings.Repeat("x", i), got)
+			} else {
+				assert.Empty(t, outputID)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Less(t, requests.Load(), int32(5))
+
+	found, err := c.Exists(ctx, []string{actionID(1), actionID(11)})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cachers.ActionValue{actionID(1): {OutputID: actionID(101), Size: 1}}, found)
+}
+
+func TestCompression(t *testing.T) {
+	for _, storeCompressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("storeCompressed=%v", storeCompressed), func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.compressions = []*cachers.Compression{cachers.LookupCompression("gzip")}
+			srv.storeCompressed = storeCompressed
+			var putEncoding string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "PUT" {
+					putEncoding = r.Header.Get("Content-Encoding")
+				}
+				srv.ServeHTTP(w, r)
+			}))
+			defer ts.Close()
+			ctx := context.Background()
+
+			gz := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{Compression: cachers.LookupCompression("gzip")}, false)
+			plain := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+
+			// The first request teaches the client that the server takes gzip.
+			_, _, err := getString(t, gz, testActionID)
+			require.NoError(t, err)
+			body := strings.Repeat("compress me ", 1000)
+			require.NoError(t, gz.Put(ctx, testActionID, testOutputID, int64(len(body)), strings.NewReader(body)))
+			assert.Equal(t, "gzip", putEncoding)
+
+			raw, err := os.ReadFile(filepath.Join(srv.dir, "o-"+testOutputID))
+			require.NoError(t, err)
+			assert.Equal(t, body, string(raw))
+			srv.compressing.Wait()
+			_, err = os.Stat(compressedFilename(srv.dir, testOutputID, srv.compressions[0]))
+			assert.Equal(t, storeCompressed, err == nil)
+
+			for _, c := range []*cachers.HTTPCache{gz, plain} {
+				outputID, size, rc, err := c.Get(ctx, testActionID)
+				require.NoError(t, err)
+				got, err := io.ReadAll(rc)
+				require.NoError(t, err)
+				_ = rc.Close()
+				assert.Equal(t, testOutputID, outputID)
+				assert.Equal(t, int64(len(body)), size)
+				assert.Equal(t, body, string(got))
+			}
+		})
+	}
+}
+
+func TestRemoteStorage(t *testing.T) {
+	upstream := httptest.NewServer(newTestServer(t))
+	defer upstream.Close()
+	srv := &server{store: newRemoteStorage(cachers.NewHttpCache(upstream.URL, cachers.HTTPCacheOptions{}, false))}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	require.NoError(t, c.Put(context.Background(), testActionID, testOutputID, 5, strings.NewReader("hello")))
+
+	get := func(path string) (int, string) {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close() //nolint:errcheck
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(b)
+	}
+	// Outputs are only known once their action was looked up.
+	code, _ := get("/output/" + testOutputID)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body := get("/action/" + testActionID)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, testOutputID)
+	code, body = get("/output/" + testOutputID)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", body)
+}
+
+// fakeS3 is an in-memory S3 bucket for cachers.NewS3Cache.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*s3.PutObjectInput
+	bodies  map[string][]byte
+	gets    int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]*s3.PutObjectInput{}, bodies: map[string][]byte{}}
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[*in.Key], f.bodies[*in.Key] = in, b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	size := int64(len(f.bodies[*in.Key]))
+	return &s3.HeadObjectOutput{ContentLength: &size, Metadata: obj.Metadata}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	f.gets++
+	b := f.bodies[*in.Key]
+	if in.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*in.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		b = b[start : end+1]
+	}
+	size := int64(len(b))
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b)), ContentLength: &size, Metadata: obj.Metadata}, nil
+}
+
+func TestS3Storage(t *testing.T) {
+	bucket := newFakeS3()
+	newServer := func() *httptest.Server {
+		srv := &server{store: newRemoteStorage(cachers.NewS3Cache(bucket, "bucket", "prefix", false))}
+		ts := httptest.NewServer(srv)
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	ts := newServer()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	require.NoError(t, c.Put(context.Background(), testActionID, testOutputID, 5, strings.NewReader("hello")))
+
+	do := func(ts *httptest.Server, method, path, rng string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close() //nolint:errcheck
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(b)
+	}
+	code, body := do(ts, "GET", "/action/"+testActionID, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, testOutputID)
+	code, _ = do(ts, "HEAD", "/output/"+testOutputID, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Zero(t, bucket.gets, "lookups don't download the output")
+
+	// A restarted server finds outputs it hasn't seen looked up.
+	ts = newServer()
+	code, body = do(ts, "GET", "/output/"+testOutputID, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello", body)
+	code, body = do(ts, "GET", "/output/"+testOutputID, "bytes=1-")
+	assert.Equal(t, http.StatusPartialContent, code)
+	assert.Equal(t, "ello", body)
+	assert.Equal(t, 2, bucket.gets)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// runServer serves hs with serve until ctx is done, then stops accepting
+// connections and lets in-flight requests finish for up to drain before
+// closing the remaining connections.
+func runServer(ctx context.Context, hs *http.Server, serve func() error, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- serve() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down; waiting up to %v for in-flight requests", drain)
+	sctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := hs.Shutdown(sctx); err != nil {
+		log.Printf("shutdown: %v; closing remaining connections", err)
+		_ = hs.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// startLoops starts the background loops of s, which run until ctx is done
+// or close stops them, after repairing the store once in the background.
+// Scrubs run every scrubInterval, if positive.
+func (s *server) startLoops(ctx context.Context, scrubInterval time.Duration) {
+	ctx, s.stopLoops = context.WithCancel(ctx)
+	s.loops.Add(2)
+	go func() {
+		defer s.loops.Done()
+		s.sampleLoop(ctx)
+	}()
+	go func() {
+		defer s.loops.Done()
+		s.repair(ctx)
+	}()
+	if scrubInterval > 0 {
+		s.loops.Add(1)
+		go func() {
+			defer s.loops.Done()
+			s.scrubLoop(ctx, scrubInterval)
+		}()
+	}
+}
+
+// close stops the background work of s and flushes what it has pending,
+// once no more requests come in. Queued replications get up to timeout to
+// reach the peers.
+func (s *server) close(timeout time.Duration) {
+	if s.stopLoops != nil {
+		s.stopLoops()
+	}
+	s.loops.Wait()
+	s.replicas.close(timeout)
+	s.evict.close()
+	s.compressing.Wait()
+	if err := s.store.Close(); err != nil {
+		log.Printf("closing storage: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- runServer(ctx, hs, func() error { return hs.Serve(ln) }, 5*time.Second) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer res.Body.Close() //nolint:errcheck
+		b, err := io.ReadAll(res.Body)
+		resc <- result{string(b), err}
+	}()
+	<-started
+	cancel()
+	// New connections are refused while the in-flight request drains.
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			_ = c.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	res := <-resc
+	require.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	assert.NoError(t, <-runErr)
+}
+
+func TestUploadLimits(t *testing.T) {
+	srv := newTestServer(t)
+	srv.maxUpload = 10
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	put := func(body string) int {
+		req, err := http.NewRequest("PUT", ts.URL+"/aaaa/bbbb", strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, put("small"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, put("much too large"))
+
+	// An upload cut off halfway leaves nothing behind.
+	c, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(c, "PUT /cccc/dddd HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool {
+		ents, err := os.ReadDir(srv.dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		return assert.ObjectsAreEqual([]string{"a-aaaa", "o-bbbb"}, names)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// storage is what the server serves from: a cachers.LocalCache or
+// cachers.RemoteCache adapted to the needs of the HTTP handlers.
+type storage interface {
+	cachers.Cache
+
+	// Get returns the output of actionID, or an empty outputID on a miss.
+	// The caller must close body.
+	Get(ctx context.Context, actionID string) (outputID string, size int64, body io.ReadCloser, err error)
+
+	// GetOutput returns the output with outputID, or a nil body on a miss.
+	// The caller must close body.
+	GetOutput(ctx context.Context, outputID string) (size int64, body io.ReadCloser, err error)
+
+	// Put stores an output. diskPath is where it ended up on local disk,
+	// or empty if the storage isn't on local disk.
+	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error)
+
+	// Admin returns the cache the admin API manages, or nil if the
+	// storage doesn't support it.
+	Admin() cachers.AdminCache
+}
+
+// storageOptions configures newStorage.
+type storageOptions struct {
+	Backend string // "disk", "s3" or "disk+s3"
+	Dir     string // for the disk backends
+
+	S3Bucket, S3Region, S3Prefix string
+
+	// Upstream, if set, makes the disk backend a pull-through proxy of
+	// another go-cacher-server ("http://host:port") or an S3 bucket
+	// ("s3://bucket/prefix"). UpstreamWrite is how puts reach it, see
+	// proxyStorage.
+	Upstream      string
+	UpstreamWrite string
+	UpstreamAuth  cachers.HTTPAuth
+
+	// Namespace, if set, puts the storage in the namespace's own
+	// directory, S3 prefix and upstream namespace.
+	Namespace string
+
+	Verbose bool
+}
+
+// newStorage returns the storage for the named backend:
+//
+//	disk     a SimpleDiskCache in dir, proxying Upstream if set
+//	s3       an S3Cache in bucket under prefix
+//	disk+s3  both, with the disk proxying S3
+func newStorage(ctx context.Context, opts storageOptions) (storage, error) {
+	if opts.Namespace != "" {
+		opts.Dir = namespaceDir(opts.Dir, opts.Namespace)
+		opts.S3Prefix = path.Join(opts.S3Prefix, "ns", opts.Namespace)
+	}
+	switch opts.Backend {
+	case "disk":
+		disk := newDiskCache(opts)
+		if opts.Upstream == "" {
+			return newLocalStorage(disk), nil
+		}
+		upstream, err := newUpstream(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return newProxyStorage(disk, upstream, opts.UpstreamWrite, opts.Verbose)
+	case "s3", "disk+s3":
+		if opts.Upstream != "" {
+			return nil, fmt.Errorf("backend %q can't have an upstream", opts.Backend)
+		}
+		s3Cache, err := newS3Cache(ctx, opts.S3Bucket, opts.S3Region, opts.S3Prefix, opts.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Backend == "s3" {
+			return newRemoteStorage(s3Cache), nil
+		}
+		return newProxyStorage(newDiskCache(opts), s3Cache, writeThrough, opts.Verbose)
+	}
+	return nil, fmt.Errorf("unknown backend %q", opts.Backend)
+}
+
+// newDiskCache returns the SimpleDiskCache in opts.Dir. The server repairs
+// it itself, see server.repair, so Start doesn't.
+func newDiskCache(opts storageOptions) *cachers.SimpleDiskCache {
+	dc := cachers.NewSimpleDiskCache(opts.Verbose, opts.Dir)
+	dc.SetStaleTempAge(-1)
+	return dc
+}
+
+// newUpstream returns the RemoteCache for opts.Upstream.
+func newUpstream(ctx context.Context, opts storageOptions) (cachers.RemoteCache, error) {
+	u, err := url.Parse(opts.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("bad upstream: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "unix":
+		return cachers.NewHttpCache(opts.Upstream, cachers.HTTPCacheOptions{Auth: opts.UpstreamAuth, Namespace: opts.Namespace}, opts.Verbose), nil
+	case "s3":
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if opts.Namespace != "" {
+			prefix = path.Join(prefix, "ns", opts.Namespace)
+		}
+		return newS3Cache(ctx, u.Host, opts.S3Region, prefix, opts.Verbose)
+	}
+	return nil, fmt.Errorf("upstream %q is neither an http(s)://, unix: nor s3:// URL", opts.Upstream)
+}
+
+func newS3Cache(ctx context.Context, bucket, region, prefix string, verbose bool) (cachers.RemoteCache, error) {
+	if bucket == "" {
+		return nil, errors.New("no S3 bucket given")
+	}
+	var loadOpts []func(*config.LoadOptions) error
+	if region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return cachers.NewS3Cache(s3.NewFromConfig(cfg), bucket, prefix, verbose), nil
+}
+
+// localStorage serves from a LocalCache.
+type localStorage struct {
+	cachers.LocalCache
+	outputs *outputIndex
+}
+
+func newLocalStorage(lc cachers.LocalCache) *localStorage {
+	return &localStorage{LocalCache: lc, outputs: newOutputIndex()}
+}
+
+func (ls *localStorage) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	outputID, diskPath, err := ls.LocalCache.Get(ctx, actionID)
+	if err != nil || outputID == "" {
+		return "", 0, nil, err
+	}
+	size, f, err := openOutput(diskPath)
+	if err != nil || f == nil {
+		return "", 0, nil, err
+	}
+	ls.outputs.add(outputID, actionID)
+	return outputID, size, f, nil
+}
+
+func (ls *localStorage) GetOutput(ctx context.Context, outputID string) (int64, io.ReadCloser, error) {
+	if og, ok := ls.LocalCache.(cachers.OutputGetter); ok {
+		diskPath, err := og.GetOutput(ctx, outputID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if diskPath != "" {
+			size, f, err := openOutput(diskPath)
+			if err != nil {
+				return 0, nil, err
+			}
+			if f != nil {
+				return size, f, nil
+			}
+		}
+	}
+	return ls.outputs.getOutput(ctx, outputID, ls.Get)
+}
+
+func (ls *localStorage) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	return ls.LocalCache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (ls *localStorage) Admin() cachers.AdminCache {
+	ac, _ := ls.LocalCache.(cachers.AdminCache)
+	return ac
+}
+
+// openOutput opens the output file at diskPath.
+// It returns a nil file if it doesn't exist.
+func openOutput(diskPath string) (size int64, f *os.File, err error) {
+	f, err = os.Open(diskPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return 0, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return 0, nil, err
+	}
+	return fi.Size(), f, nil
+}
+
+// remoteStorage serves from a RemoteCache.
+type remoteStorage struct {
+	cachers.RemoteCache
+	outputs *outputIndex
+}
+
+func newRemoteStorage(rc cachers.RemoteCache) *remoteStorage {
+	return &remoteStorage{RemoteCache: rc, outputs: newOutputIndex()}
+}
+
+// actionStatter is implemented by remote caches that can look up an action
+// without downloading its output, like cachers.S3Cache.
+type actionStatter interface {
+	Stat(ctx context.Context, actionID string) (e cachers.Entry, ok bool, err error)
+}
+
+func (rs *remoteStorage) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	var (
+		outputID string
+		size     int64
+		body     io.ReadCloser
+		err      error
+	)
+	if st, ok := rs.RemoteCache.(actionStatter); ok {
+		var e cachers.Entry
+		e, ok, err = st.Stat(ctx, actionID)
+		if ok {
+			outputID, size = e.OutputID, e.Size
+			body = &lazyBody{ctx: ctx, rc: rs.RemoteCache, actionID: actionID, outputID: outputID, size: size}
+		}
+	} else {
+		outputID, size, body, err = rs.RemoteCache.Get(ctx, actionID)
+	}
+	if err != nil || outputID == "" {
+		return "", 0, nil, err
+	}
+	rs.outputs.add(outputID, actionID)
+	return outputID, size, body, nil
+}
+
+func (rs *remoteStorage) GetOutput(ctx context.Context, outputID string) (int64, io.ReadCloser, error) {
+	size, body, err := rs.outputs.getOutput(ctx, outputID, rs.Get)
+	if err != nil || body != nil {
+		return size, body, err
+	}
+	// Not looked up since the server started, or overwritten.
+	ol, ok := rs.RemoteCache.(cachers.OutputLocator)
+	if !ok {
+		return 0, nil, nil
+	}
+	actionID, err := ol.LocateOutput(ctx, outputID)
+	if err != nil || actionID == "" {
+		return 0, nil, err
+	}
+	rs.outputs.add(outputID, actionID)
+	return rs.outputs.getOutput(ctx, outputID, rs.Get)
+}
+
+func (rs *remoteStorage) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	if err := rs.RemoteCache.Put(ctx, actionID, outputID, size, body); err != nil {
+		return "", err
+	}
+	if ol, ok := rs.RemoteCache.(cachers.OutputLocator); ok {
+		if err := ol.RecordOutput(ctx, actionID, outputID); err != nil {
+			// The entry is stored; GET /output just can't find it
+			// after a restart.
+			log.Printf("recording output %s: %v", outputID, err)
+		}
+	}
+	return "", nil
+}
+
+// lazyBody is the output of an action that is only downloaded when it's
+// first read, so lookups answered with just the output ID and size and
+// HEAD requests don't fetch it.
+type lazyBody struct {
+	ctx                context.Context
+	rc                 cachers.RemoteCache
+	actionID, outputID string
+	size               int64
+
+	off  int64 // skipped with Seek before the first Read
+	body io.ReadCloser
+}
+
+func (lb *lazyBody) Read(p []byte) (int, error) {
+	if lb.body == nil {
+		if err := lb.open(); err != nil {
+			return 0, err
+		}
+	}
+	return lb.body.Read(p)
+}
+
+// open downloads the output from lb.off on, with a ranged get if the
+// cache can do those.
+func (lb *lazyBody) open() error {
+	if rg, ok := lb.rc.(cachers.RangeGetter); ok && lb.off > 0 {
+		if lb.off >= lb.size {
+			lb.body = io.NopCloser(strings.NewReader(""))
+			return nil
+		}
+		body, err := rg.GetRange(lb.ctx, lb.actionID, lb.outputID, lb.off, lb.size-lb.off)
+		if err != nil {
+			return err
+		}
+		lb.body = body
+		return nil
+	}
+	outputID, _, body, err := lb.rc.Get(lb.ctx, lb.actionID)
+	if err != nil {
+		return err
+	}
+	if outputID != lb.outputID {
+		if body != nil {
+			_ = body.Close()
+		}
+		return fmt.Errorf("action %s changed from output %s to %q", lb.actionID, lb.outputID, outputID)
+	}
+	lb.body = body
+	if _, err := io.CopyN(io.Discard, body, lb.off); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Seek only supports skipping forward before the first Read, which is all
+// Range requests need.
+func (lb *lazyBody) Seek(offset int64, whence int) (int64, error) {
+	if lb.body != nil || whence != io.SeekCurrent || offset < 0 {
+		return 0, errors.New("lazyBody: unsupported seek")
+	}
+	lb.off += offset
+	return lb.off, nil
+}
+
+func (lb *lazyBody) Close() error {
+	if lb.body == nil {
+		return nil
+	}
+	return lb.body.Close()
+}
+
+func (rs *remoteStorage) Admin() cachers.AdminCache {
+	ac, _ := rs.RemoteCache.(cachers.AdminCache)
+	return ac
+}
+
+// outputIndexSize is the number of recent action lookups outputIndex keeps.
+const outputIndexSize = 1 << 16
+
+// outputIndex remembers which actions recently resolved to which outputs,
+// so GET /output can be served by caches that can only look up actions.
+// Clients using the two step protocol always ask for the action first.
+type outputIndex struct {
+	mu      sync.Mutex
+	actions map[string]string // outputID => actionID
+	ring    []string          // outputIDs in insertion order, for eviction
+	next    int
+}
+
+func newOutputIndex() *outputIndex {
+	return &outputIndex{
+		actions: map[string]string{},
+		ring:    make([]string, outputIndexSize),
+	}
+}
+
+func (oi *outputIndex) add(outputID, actionID string) {
+	oi.mu.Lock()
+	defer oi.mu.Unlock()
+	if _, ok := oi.actions[outputID]; ok {
+		oi.actions[outputID] = actionID
+		return
+	}
+	if old := oi.ring[oi.next]; old != "" {
+		delete(oi.actions, old)
+	}
+	oi.ring[oi.next] = outputID
+	oi.next = (oi.next + 1) % len(oi.ring)
+	oi.actions[outputID] = actionID
+}
+
+// getOutput looks outputID up through the action it was last seen for.
+func (oi *outputIndex) getOutput(ctx context.Context, outputID string,
+	get func(context.Context, string) (string, int64, io.ReadCloser, error)) (int64, io.ReadCloser, error) {
+	oi.mu.Lock()
+	actionID, ok := oi.actions[outputID]
+	oi.mu.Unlock()
+	if !ok {
+		return 0, nil, nil
+	}
+	gotOutputID, size, body, err := get(ctx, actionID)
+	if err != nil || gotOutputID == "" {
+		return 0, nil, err
+	}
+	if gotOutputID != outputID {
+		// The action was overwritten since.
+		_ = body.Close()
+		return 0, nil, nil
+	}
+	return size, body, nil
+}
+
+// namespaceDir is the directory of namespace ns in the cache directory dir.
+// The default namespace, "", is dir itself.
+func namespaceDir(dir, ns string) string {
+	if dir == "" || ns == "" {
+		return dir
+	}
+	return filepath.Join(dir, "ns", ns)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certReloader looks at the certificate files.
+// It's a variable for tests.
+var certCheckInterval = 5 * time.Second
+
+// certReloader serves a certificate and key pair from disk, reloading them
+// when either file changes so renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // newest mtime of certFile and keyFile when cert was loaded
+	checked time.Time // last time the files were looked at
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	now := time.Now()
+	if cr.cert != nil && now.Sub(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = now
+	modTime, err := cr.newestModTime()
+	if err == nil && cr.cert != nil && !modTime.After(cr.modTime) {
+		return cr.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+		if err == nil {
+			if cr.cert != nil {
+				log.Printf("reloaded TLS certificate %s", cr.certFile)
+			}
+			cr.cert, cr.modTime = &cert, modTime
+			return cr.cert, nil
+		}
+	}
+	if cr.cert == nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	// The files may be mid-rotation; keep serving the old pair and retry later.
+	log.Printf("keeping previous TLS certificate: %v", err)
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns the TLS config for serving with the given
+// certificate and key. If clientCAFile is set, clients must present a
+// certificate signed by one of its CAs.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
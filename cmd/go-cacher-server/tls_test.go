@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// writeCert creates a certificate signed by parent (or self-signed if parent
+// is nil) and writes it and its key as PEM files into dir.
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	certDir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, certDir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, certDir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, certDir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	file := func(name string) string { return filepath.Join(certDir, name) }
+
+	ts := httptest.NewUnstartedServer(newTestServer(t))
+	tlsConfig, err := serverTLSConfig(file("server.pem"), file("server-key.pem"), file("ca.pem"))
+	require.NoError(t, err)
+	// Not StartTLS, which would install its own certificate.
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Start()
+	defer ts.Close()
+	baseURL := strings.Replace(ts.URL, "http://", "https://", 1)
+
+	clientTLS, err := cachers.NewClientTLSConfig(file("ca.pem"), file("client.pem"), file("client-key.pem"))
+	require.NoError(t, err)
+	c := cachers.NewHttpCache(baseURL, cachers.HTTPCacheOptions{TLSConfig: clientTLS}, false)
+	require.NoError(t, c.Put(context.Background(), testActionID, testOutputID, 2, bytes.NewReader([]byte("hi"))))
+	outputID, body, err := getString(t, c, testActionID)
+	require.NoError(t, err)
+	assert.Equal(t, testOutputID, outputID)
+	assert.Equal(t, "hi", body)
+
+	noCertTLS, err := cachers.NewClientTLSConfig(file("ca.pem"), "", "")
+	require.NoError(t, err)
+	c = cachers.NewHttpCache(baseURL, cachers.HTTPCacheOptions{TLSConfig: noCertTLS}, false)
+	_, _, err = getString(t, c, testActionID)
+	assert.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	defer func(d time.Duration) { certCheckInterval = d }(certCheckInterval)
+	certCheckInterval = 0
+	certDir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, certDir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeServerCert := func(serial int64) {
+		writeCert(t, certDir, "server", &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "server"},
+			NotAfter:     notAfter,
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca, caKey)
+	}
+	writeServerCert(2)
+	certFile, keyFile := filepath.Join(certDir, "server.pem"), filepath.Join(certDir, "server-key.pem")
+
+	ts := httptest.NewUnstartedServer(newTestServer(t))
+	tlsConfig, err := serverTLSConfig(certFile, keyFile, "")
+	require.NoError(t, err)
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Start()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{RootCAs: roots})
+		require.NoError(t, err)
+		defer conn.Close() //nolint:errcheck
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+
+	// Rotate the pair, as a certificate manager renewing it would.
+	writeServerCert(3)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		require.NoError(t, os.Chtimes(f, later, later))
+	}
+	assert.Equal(t, int64(3), serial())
+
+	// A half written rotation keeps the previous pair in use.
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.Equal(t, int64(3), serial())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+)
+
+// errOutputMismatch is returned by a verifyingReader whose body doesn't
+// hash to its output ID.
+var errOutputMismatch = errors.New("body doesn't match output ID")
+
+// verifyingReader passes through the size bytes of an output, checking at
+// the end that they hash to outputID. As caches only store outputs read to
+// EOF, an error there keeps the output from becoming visible.
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	outputID string
+	size     int64
+	n        int64
+}
+
+func newVerifyingReader(r io.Reader, outputID string, size int64) *verifyingReader {
+	return &verifyingReader{r: r, h: sha256.New(), outputID: outputID, size: size}
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	v.n += int64(n)
+	if v.n > v.size {
+		return n, fmt.Errorf("%w: body is longer than %d bytes", errOutputMismatch, v.size)
+	}
+	if err == io.EOF {
+		err = v.check()
+	}
+	return n, err
+}
+
+// check returns io.EOF if the body read so far is the output, or an error
+// wrapping errOutputMismatch.
+func (v *verifyingReader) check() error {
+	if v.n != v.size {
+		return fmt.Errorf("%w: body has %d bytes, want %d", errOutputMismatch, v.n, v.size)
+	}
+	if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.outputID {
+		return fmt.Errorf("%w: body hashes to %s", errOutputMismatch, sum)
+	}
+	return io.EOF
+}
+
+// rejectPut answers a PUT whose body doesn't match outputID.
+func (s *server) rejectPut(w http.ResponseWriter, r *http.Request, actionID, outputID string, err error) {
+	s.metrics.rejected.Add(1)
+	log.Printf("rejected PUT of action %s output %s from %s: %v", actionID, outputID, s.clientName(r), err)
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestVerifyOutputs(t *testing.T) {
+	srv := newTestServer(t)
+	srv.verifyOutputs = true
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	c := cachers.NewHttpCache(ts.URL, cachers.HTTPCacheOptions{}, false)
+	ctx := context.Background()
+	outputID := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	big := strings.Repeat("hello ", 1000)
+	for _, body := range []string{"", "hello", big} {
+		require.NoError(t, c.Put(ctx, testActionID, outputID(body), int64(len(body)), strings.NewReader(body)))
+	}
+
+	for _, tt := range []struct {
+		outputID, body string
+	}{
+		{outputID(""), "x"},
+		{outputID("x"), ""},
+		{outputID("hello"), "jello"},
+		{testOutputID, "hello"},
+		{outputID(big), big[1:] + "!"},
+	} {
+		err := c.Put(ctx, "cccc", tt.outputID, int64(len(tt.body)), strings.NewReader(tt.body))
+		require.Error(t, err, "%q", tt.body)
+		assert.Contains(t, err.Error(), "400")
+	}
+	gotOutputID, _, err := getString(t, c, "cccc")
+	require.NoError(t, err)
+	assert.Empty(t, gotOutputID)
+	assert.Equal(t, int64(5), srv.metrics.rejected.Load())
+
+	// Nothing of the rejected uploads is left on disk.
+	des, err := os.ReadDir(srv.dir)
+	require.NoError(t, err)
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		"a-" + testActionID,
+		"o-" + outputID(""),
+		"o-" + outputID("hello"),
+		"o-" + outputID(big),
+	}, names)
+}
@@ -8,9 +8,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
@@ -30,6 +34,11 @@ const (
 	// path to local disk directory. defaults to os.UserCacheDir()/go-cacher
 	envVarDiskCacheDir = "GOCACHE_DISK_DIR"
 
+	// Repair of the disk cache on start, see cachers.SimpleDiskCache.SetStaleTempAge
+	// and SetRepairInterval.
+	envVarDiskStaleTempAge   = "GOCACHE_STALE_TEMP_AGE"  // like "1h", negative disables the repair
+	envVarDiskRepairInterval = "GOCACHE_REPAIR_INTERVAL" // like "24h", negative repairs on every start
+
 	// S3 cache
 	envVarS3CacheRegion        = "GOCACHE_AWS_REGION"
 	envVarS3AwsAccessKey       = "GOCACHE_AWS_ACCESS_KEY"
@@ -38,8 +47,46 @@ const (
 	envVarS3BucketName         = "GOCACHE_S3_BUCKET"
 	envVarS3CacheKey           = "GOCACHE_CACHE_KEY"
 
+	// Layout of keys in the remote cache, see cachers.ExpandKeyTemplate.
+	// Defaults to cachers.DefaultKeyTemplate for S3 and to no prefix for HTTP.
+	envVarKeyTemplate = "GOCACHE_KEY_TEMPLATE"
+
 	// HTTP cache - optional cache server HTTP prefix (scheme and authority only);
+	// a comma separated list shards the cache over several servers.
 	envVarHttpCacheServerBase = "GOCACHE_HTTP_SERVER_BASE"
+
+	// Number of servers each entry is stored on when sharding, default 1.
+	envVarHttpReplicas = "GOCACHE_HTTP_REPLICAS"
+
+	// HTTP cache server namespace to use, see go-cacher-server -namespaces.
+	envVarHttpNamespace = "GOCACHE_HTTP_NAMESPACE"
+
+	// HTTP cache credentials: a bearer token (directly or read from a file),
+	// or basic auth user and password. The token takes precedence.
+	envVarHttpToken     = "GOCACHE_HTTP_TOKEN"
+	envVarHttpTokenFile = "GOCACHE_HTTP_TOKEN_FILE"
+	envVarHttpUser      = "GOCACHE_HTTP_USER"
+	envVarHttpPassword  = "GOCACHE_HTTP_PASSWORD"
+
+	// HTTP cache TLS: extra CA bundle to trust, and client certificate and
+	// key for mutual TLS. All PEM files.
+	envVarHttpCAFile     = "GOCACHE_HTTP_CA_FILE"
+	envVarHttpClientCert = "GOCACHE_HTTP_CLIENT_CERT"
+	envVarHttpClientKey  = "GOCACHE_HTTP_CLIENT_KEY"
+
+	// HTTP cache client tuning, see cachers.HTTPCacheOptions.
+	envVarHttpTimeout      = "GOCACHE_HTTP_TIMEOUT"        // per attempt, like "2m"
+	envVarHttpMaxRetries   = "GOCACHE_HTTP_MAX_RETRIES"    // negative disables retries
+	envVarHttpMaxIdleConns = "GOCACHE_HTTP_MAX_IDLE_CONNS" // idle connections kept to the server
+	envVarHttpMaxConns     = "GOCACHE_HTTP_MAX_CONNS"      // limit of connections to the server
+	envVarHttpBatchWindow  = "GOCACHE_HTTP_BATCH_WINDOW"   // coalesce gets within this window, like "2ms"
+	envVarHttpCompression  = "GOCACHE_HTTP_COMPRESSION"    // transfer compression, like "gzip"
+
+	// Ranged downloads of large outputs from S3 or HTTP caches, see
+	// cachers.RangedDownloads. Default to cachers.DefaultRangedDownloads.
+	envVarDownloadThreshold   = "GOCACHE_DOWNLOAD_THRESHOLD"   // in bytes, 0 disables
+	envVarDownloadChunkSize   = "GOCACHE_DOWNLOAD_CHUNK_SIZE"  // in bytes
+	envVarDownloadParallelism = "GOCACHE_DOWNLOAD_PARALLELISM" // chunks downloaded at once
 )
 
 var (
@@ -99,18 +146,65 @@ func maybeS3Cache(ctx context.Context, env Env) (cachers.RemoteCache, error) {
 		// We need at least name of bucket and valid aws config
 		return nil, nil
 	}
+	tmpl := env.Get(envVarKeyTemplate)
+	if tmpl == "" {
+		tmpl = cachers.DefaultKeyTemplate
+	}
+	prefix, err := keyPrefix(env, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	s3Client := s3.NewFromConfig(*awsConfig)
+	s3Cache := cachers.NewS3Cache(s3Client, bucket, prefix, *verbose)
+	rd, err := rangedDownloadsFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	s3Cache.SetRangedDownloads(rd)
+	return s3Cache, nil
+}
+
+func rangedDownloadsFromEnv(env Env) (cachers.RangedDownloads, error) {
+	rd := cachers.DefaultRangedDownloads
+	for _, iv := range []struct {
+		key string
+		dst *int64
+	}{
+		{envVarDownloadThreshold, &rd.Threshold},
+		{envVarDownloadChunkSize, &rd.ChunkSize},
+	} {
+		if v := env.Get(iv.key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return rd, fmt.Errorf("%s: %w", iv.key, err)
+			}
+			*iv.dst = n
+		}
+	}
+	if v := env.Get(envVarDownloadParallelism); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return rd, fmt.Errorf("%s: %w", envVarDownloadParallelism, err)
+		}
+		rd.Parallelism = n
+	}
+	return rd, nil
+}
+
+func keyPrefix(env Env, tmpl string) (string, error) {
 	cacheKey := env.Get(envVarS3CacheKey)
 	if cacheKey == "" {
 		cacheKey = defaultCacheKey
 	}
-	s3Client := s3.NewFromConfig(*awsConfig)
-	s3Cache := cachers.NewS3Cache(s3Client, bucket, cacheKey, *verbose)
-	return s3Cache, nil
+	return cachers.ExpandKeyTemplate(tmpl, cacheKey, env.Get)
 }
 
 func getCache(ctx context.Context, env Env, verbose bool) cachers.LocalCache {
-	dir := getDir(env)
-	var local cachers.LocalCache = cachers.NewSimpleDiskCache(verbose, dir)
+	disk, err := diskCacheFromEnv(env, verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var local cachers.LocalCache = disk
 
 	remote, err := maybeS3Cache(ctx, env)
 	if err != nil {
@@ -132,12 +226,132 @@ func getCache(ctx context.Context, env Env, verbose bool) cachers.LocalCache {
 	return local
 }
 
+func diskCacheFromEnv(env Env, verbose bool) (*cachers.SimpleDiskCache, error) {
+	dc := cachers.NewSimpleDiskCache(verbose, getDir(env))
+	for _, dv := range []struct {
+		key string
+		set func(time.Duration)
+	}{
+		{envVarDiskStaleTempAge, dc.SetStaleTempAge},
+		{envVarDiskRepairInterval, dc.SetRepairInterval},
+	} {
+		if v := env.Get(dv.key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dv.key, err)
+			}
+			dv.set(d)
+		}
+	}
+	return dc, nil
+}
+
 func maybeHttpCache(env Env) (cachers.RemoteCache, error) {
 	serverBase := env.Get(envVarHttpCacheServerBase)
 	if serverBase == "" {
 		return nil, nil
 	}
-	return cachers.NewHttpCache(serverBase, *verbose), nil
+	opts := cachers.HTTPCacheOptions{Namespace: env.Get(envVarHttpNamespace)}
+	if tmpl := env.Get(envVarKeyTemplate); tmpl != "" {
+		var err error
+		opts.KeyPrefix, err = keyPrefix(env, tmpl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auth, err := httpAuthFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	opts.Auth = auth
+	caFile, certFile, keyFile := env.Get(envVarHttpCAFile), env.Get(envVarHttpClientCert), env.Get(envVarHttpClientKey)
+	if caFile != "" || certFile != "" || keyFile != "" {
+		opts.TLSConfig, err = cachers.NewClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := httpTuningFromEnv(env, &opts); err != nil {
+		return nil, err
+	}
+	if opts.RangedDownloads, err = rangedDownloadsFromEnv(env); err != nil {
+		return nil, err
+	}
+	bases := strings.Split(serverBase, ",")
+	if len(bases) == 1 {
+		return cachers.NewHttpCache(serverBase, opts, *verbose), nil
+	}
+	var replicas int
+	if v := env.Get(envVarHttpReplicas); v != "" {
+		if replicas, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarHttpReplicas, err)
+		}
+	}
+	for i, b := range bases {
+		bases[i] = strings.TrimSpace(b)
+	}
+	return cachers.NewShardedHttpCache(bases, replicas, opts, *verbose), nil
+}
+
+func httpTuningFromEnv(env Env, opts *cachers.HTTPCacheOptions) error {
+	if name := env.Get(envVarHttpCompression); name != "" {
+		opts.Compression = cachers.LookupCompression(name)
+		if opts.Compression == nil {
+			return fmt.Errorf("%s: unknown compression %q", envVarHttpCompression, name)
+		}
+	}
+	for _, dv := range []struct {
+		key string
+		dst *time.Duration
+	}{
+		{envVarHttpTimeout, &opts.RequestTimeout},
+		{envVarHttpBatchWindow, &opts.BatchWindow},
+	} {
+		if v := env.Get(dv.key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", dv.key, err)
+			}
+			*dv.dst = d
+		}
+	}
+	for _, iv := range []struct {
+		key string
+		dst *int
+	}{
+		{envVarHttpMaxRetries, &opts.MaxRetries},
+		{envVarHttpMaxIdleConns, &opts.MaxIdleConnsPerHost},
+		{envVarHttpMaxConns, &opts.MaxConnsPerHost},
+	} {
+		if v := env.Get(iv.key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", iv.key, err)
+			}
+			*iv.dst = n
+		}
+	}
+	return nil
+}
+
+func httpAuthFromEnv(env Env) (cachers.HTTPAuth, error) {
+	token := env.Get(envVarHttpToken)
+	if token == "" {
+		if file := env.Get(envVarHttpTokenFile); file != "" {
+			var err error
+			token, err = cachers.ReadTokenFile(file)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if token != "" {
+		return cachers.BearerTokenAuth{Token: token}, nil
+	}
+	if user := env.Get(envVarHttpUser); user != "" {
+		return cachers.BasicAuth{Username: user, Password: env.Get(envVarHttpPassword)}, nil
+	}
+	return nil, nil
 }
 
 func getDir(env Env) string {
@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"maps"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
 )
 
 type mapEnv struct {
@@ -66,3 +70,57 @@ func TestMaybeHttpCache(t *testing.T) {
 		assert.NotNil(t, client)
 	})
 }
+
+func TestKeyPrefixFromEnv(t *testing.T) {
+	env := &mapEnv{m: map[string]string{envVarS3CacheKey: "v2", "GOOS": "plan9", "GOARCH": "mips"}}
+	prefix, err := keyPrefix(env, cachers.DefaultKeyTemplate)
+	assert.NoError(t, err)
+	assert.Equal(t, "cache/v2/mips/plan9", prefix)
+}
+
+func TestDiskCacheFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	_, err := diskCacheFromEnv(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarDiskRepairInterval: "daily"}}, false)
+	assert.ErrorContains(t, err, envVarDiskRepairInterval)
+
+	dc, err := diskCacheFromEnv(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarDiskStaleTempAge: "-1s"}}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, dc.Start(context.Background()))
+	assert.NoError(t, dc.Close())
+	assert.NoFileExists(t, filepath.Join(dir, "repair-stamp"), "repair should be disabled")
+}
+
+func TestMaybeHttpCacheKeyTemplate(t *testing.T) {
+	env := &mapEnv{
+		m: map[string]string{
+			envVarHttpCacheServerBase: "http://localhost:8080",
+			envVarKeyTemplate:         "cache/{unknown}",
+		},
+	}
+	client, err := maybeHttpCache(env)
+	assert.Error(t, err)
+	assert.Nil(t, client)
+}
+
+func TestHttpAuthFromEnv(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0600))
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want cachers.HTTPAuth
+	}{
+		{name: "none", env: map[string]string{}, want: nil},
+		{name: "token", env: map[string]string{envVarHttpToken: "tok", envVarHttpUser: "u"}, want: cachers.BearerTokenAuth{Token: "tok"}},
+		{name: "token file", env: map[string]string{envVarHttpTokenFile: tokenFile}, want: cachers.BearerTokenAuth{Token: "file-token"}},
+		{name: "basic", env: map[string]string{envVarHttpUser: "u", envVarHttpPassword: "p"}, want: cachers.BasicAuth{Username: "u", Password: "p"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := httpAuthFromEnv(&mapEnv{m: tt.env})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}